@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events written to the --events-file.
+const (
+	eventSessionValidated   = "session_validated"
+	eventGUIDResolved       = "guid_resolved"
+	eventStagingStarted     = "staging_started"
+	eventStagingFinished    = "staging_finished"
+	eventDeploymentStarted  = "deployment_started"
+	eventDeploymentFinished = "deployment_finished"
+	eventScaleStarted       = "scale_started"
+	eventScaleFinished      = "scale_finished"
+	eventRestartRequested   = "instance_restart_requested"
+	eventInstancePolled     = "instance_polled"
+	eventInstanceHealthy    = "instance_healthy"
+	eventInstanceTimedOut   = "instance_timed_out"
+)
+
+// event is a single state transition of the rollout.
+type event struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	App       string    `json:"app,omitempty"`
+	GUID      string    `json:"guid,omitempty"`
+	Process   string    `json:"process,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	Instances *int      `json:"instances,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Uptime    *int      `json:"uptime,omitempty"`
+	Running   *bool     `json:"running,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// eventLog writes one JSON event per line. Nothing is written until a writer
+// is set with --events-file.
+type eventLog struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// emit stamps the event with the current time and writes it out.
+func (l *eventLog) emit(e event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return
+	}
+
+	e.Time = now()
+	if line, err := json.Marshal(e); err == nil {
+		l.writer.Write(append(line, '\n'))
+	}
+}
+
+// event returns an event about the target for the given instance.
+func (t target) event(name string, instanceID string) event {
+	return event{Event: name, App: t.appName, GUID: t.appGUID, Process: t.processType, Instance: instanceID}
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// openEventsFile sends events to the given file, or to stderr for "-", and
+// returns a function that closes the file and stops the event log.
+func openEventsFile(path string) (func() error, error) {
+	writer := stderr
+	closeFile := func() error { return nil }
+
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		writer, closeFile = file, file.Close
+	}
+
+	events.mutex.Lock()
+	events.writer = writer
+	events.mutex.Unlock()
+
+	return func() error {
+		events.mutex.Lock()
+		events.writer = nil
+		events.mutex.Unlock()
+
+		return closeFile()
+	}, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_EventsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolling-restart-events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	eventsPath := filepath.Join(dir, "events.ndjson")
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--events-file", eventsPath, "testApp"})
+
+	file, err := os.Open(eventsPath)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var names []string
+	var polled event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		names = append(names, e.Event)
+		if e.Event == eventInstancePolled && e.Instance == "0" {
+			polled = e
+		}
+	}
+
+	require.Equal(t, []string{
+		eventSessionValidated,
+		eventGUIDResolved,
+		eventScaleStarted,
+		eventScaleFinished,
+		eventInstancePolled,
+		eventInstanceTimedOut,
+		eventRestartRequested,
+		eventInstancePolled,
+		eventInstanceHealthy,
+		eventScaleStarted,
+		eventScaleFinished,
+	}, names)
+
+	require.Equal(t, "testApp", polled.App)
+	require.Equal(t, "valid-app-guid", polled.GUID)
+	require.Equal(t, "RUNNING", polled.State)
+	require.Equal(t, 5, *polled.Uptime)
+	require.True(t, *polled.Running)
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_EventsToStderr(t *testing.T) {
+	var eventsBuffer bytes.Buffer
+	oldStderr := stderr
+	defer func() { stderr = oldStderr }()
+	stderr = &eventsBuffer
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, alwaysRestartingResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--events-file", "-", "testApp"})
+
+	lines := bytes.Split(bytes.TrimSpace(eventsBuffer.Bytes()), []byte("\n"))
+	var last event
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &last))
+	require.Equal(t, eventInstanceTimedOut, last.Event)
+	require.Equal(t, "0", last.Instance)
+	require.Equal(t, exitCode, 1)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin"
+)
+
+// healthClient is used for the per instance readiness checks.
+var healthClient = &http.Client{Timeout: 5 * time.Second}
+
+// routeList is a page of the V3 routes of an app.
+type routeList struct {
+	Resources []struct {
+		URL string `json:"url"`
+	} `json:"resources"`
+}
+
+// resolveHealthURL turns the --health-url flag into a full URL. Absolute URLs
+// are used as they are, paths are appended to the first route of the app.
+// With --all-in-org the app may be in another space than the targeted one, so
+// its routes are looked up by GUID rather than by name.
+func resolveHealthURL(conn plugin.CliConnection, appName string, appGUID string) (string, error) {
+	if strings.HasPrefix(healthURL, "http://") || strings.HasPrefix(healthURL, "https://") {
+		return healthURL, nil
+	}
+
+	if allInOrg {
+		return resolveHealthURLByGUID(conn, appName, appGUID)
+	}
+
+	app, err := conn.GetApp(appName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(app.Routes) == 0 {
+		return "", fmt.Errorf("The app %s has no routes to run the health check against.", appName)
+	}
+
+	route := app.Routes[0]
+	host := route.Domain.Name
+	if route.Host != "" {
+		host = route.Host + "." + host
+	}
+
+	return "https://" + host + route.Path + "/" + strings.TrimPrefix(healthURL, "/"), nil
+}
+
+func resolveHealthURLByGUID(conn plugin.CliConnection, appName string, appGUID string) (string, error) {
+	var routes routeList
+
+	routesJSON, err := curlV3(conn, "GET", fmt.Sprintf("/v3/apps/%s/routes", appGUID), "")
+	if err != nil {
+		return "", err
+	}
+
+	if err = json.Unmarshal(routesJSON, &routes); err != nil {
+		return "", err
+	}
+
+	if len(routes.Resources) == 0 {
+		return "", fmt.Errorf("The app %s has no routes to run the health check against.", appName)
+	}
+
+	return "https://" + routes.Resources[0].URL + "/" + strings.TrimPrefix(healthURL, "/"), nil
+}
+
+// checkInstanceHealth requests the health URL from a single instance by
+// routing on the X-Cf-App-Instance header, returning an error describing why
+// the instance is not ready yet.
+func checkInstanceHealth(url string, appGUID string, instanceID string) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Cf-App-Instance", appGUID+":"+instanceID)
+
+	response, err := healthClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if healthStatus == 0 && (response.StatusCode < 200 || response.StatusCode > 299) {
+		return fmt.Errorf("Health check returned status %d.", response.StatusCode)
+	}
+
+	if healthStatus != 0 && response.StatusCode != healthStatus {
+		return fmt.Errorf("Health check returned status %d, expected %d.", response.StatusCode, healthStatus)
+	}
+
+	if healthBody != nil {
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+
+		if !healthBody.Match(body) {
+			return errors.New("Health check response did not match the expected body.")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"code.cloudfoundry.org/cli/plugin/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_Success_HealthCheck(t *testing.T) {
+	var instanceHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instanceHeaders = append(instanceHeaders, r.Header.Get("X-Cf-App-Instance"))
+		w.Write([]byte(`{"status":"UP"}`))
+	}))
+	defer server.Close()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--health-url", server.URL + "/health", "--health-body", "UP", "testApp"})
+
+	require.Equal(t, []string{"valid-app-guid:0", "valid-app-guid:1"}, instanceHeaders)
+	require.Equal(t, "Finished restart of app instances for testApp.\n", output[3])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_HealthCheckNeverPasses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--health-url", server.URL + "/health", "testApp"})
+
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Contains(t, output[2], "Application did not restart within 1 Second(s), failing out.")
+	require.Equal(t, exitCode, 1)
+}
+
+func TestCheckInstanceHealth_ExpectedStatusAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("DOWN"))
+	}))
+	defer server.Close()
+
+	defer func() { healthStatus, healthBody = 0, nil }()
+
+	healthStatus = http.StatusOK
+	require.EqualError(t, checkInstanceHealth(server.URL, "guid", "0"), "Health check returned status 202, expected 200.")
+
+	healthStatus = http.StatusAccepted
+	healthBody = regexp.MustCompile("^UP$")
+	require.EqualError(t, checkInstanceHealth(server.URL, "guid", "0"), "Health check response did not match the expected body.")
+
+	healthBody = regexp.MustCompile("^DOWN$")
+	require.NoError(t, checkInstanceHealth(server.URL, "guid", "0"))
+}
+
+func TestResolveHealthURL_UsesFirstRoute(t *testing.T) {
+	resetOutput()
+	defer func() { healthURL = "" }()
+
+	oldAllInOrg := allInOrg
+	defer func() { allInOrg = oldAllInOrg }()
+	allInOrg = false
+
+	cliConn.GetAppReturns(plugin_models.GetAppModel{
+		Routes: []plugin_models.GetApp_RouteSummary{
+			{Host: "test-app", Domain: plugin_models.GetApp_DomainFields{Name: "apps.example.com"}},
+		},
+	}, nil)
+
+	healthURL = "/health"
+	url, err := resolveHealthURL(cliConn, "testApp", "valid-app-guid")
+
+	require.NoError(t, err)
+	require.Equal(t, "https://test-app.apps.example.com/health", url)
+}
+
+func TestResolveHealthURL_AllInOrgUsesRoutesOfTheAppGUID(t *testing.T) {
+	resetOutput()
+	defer func() { healthURL, allInOrg = "", false }()
+
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/apps/other-space-app-guid/routes"}) {
+			return []string{`{"resources": [{"url": "other-app.apps.example.com/api"}]}`}, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+
+	healthURL, allInOrg = "/health", true
+	url, err := resolveHealthURL(cliConn, "testApp", "other-space-app-guid")
+
+	require.NoError(t, err)
+	require.Equal(t, "https://other-app.apps.example.com/api/health", url)
+	require.Equal(t, 0, cliConn.GetAppCallCount())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+)
+
+// junitTestSuites is the root of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite holds the instance restarts of one application process.
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is the restart of a single instance.
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport converts the run report into JUnit test suites. Apps that
+// failed before any instance was restarted get a single failed test case.
+func junitReport(r *runReport) junitTestSuites {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	suites := junitTestSuites{}
+	for _, app := range r.Apps {
+		name := app.App
+		if app.Process != "" {
+			name = fmt.Sprintf("%s (%s)", app.App, app.Process)
+		}
+
+		suite := junitTestSuite{Name: name}
+		var total time.Duration
+
+		for _, instance := range app.Instances {
+			finished := now()
+			if instance.Finished != nil {
+				finished = *instance.Finished
+			}
+			duration := finished.Sub(instance.Started)
+			total += duration
+
+			testCase := junitTestCase{Name: "instance " + instance.Index, ClassName: name, Time: junitSeconds(duration)}
+			if instance.Result != resultSucceeded {
+				message := instance.Error
+				if message == "" {
+					message = "The restart of the instance did not finish."
+				}
+				testCase.Failure = &junitFailure{Message: message, Text: message}
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+
+		if len(app.Instances) == 0 && app.Error != "" {
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      "restart",
+				ClassName: name,
+				Time:      junitSeconds(0),
+				Failure:   &junitFailure{Message: app.Error, Text: app.Error},
+			})
+		}
+
+		for _, testCase := range suite.Cases {
+			if testCase.Failure != nil {
+				suite.Failures++
+			}
+		}
+		suite.Tests = len(suite.Cases)
+		suite.Time = junitSeconds(total)
+
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	return suites
+}
+
+// writeJUnitReport writes the run report as JUnit XML to the given path.
+func writeJUnitReport(path string, r *runReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	if err = encoder.Encode(junitReport(r)); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func junitSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
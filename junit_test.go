@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_JUnitReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolling-restart-junit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	junitPath := filepath.Join(dir, "report.xml")
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--junit", junitPath, "--on-failure", "continue", "testApp"})
+
+	content, err := ioutil.ReadFile(junitPath)
+	require.NoError(t, err)
+
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(content, &suites))
+
+	require.Len(t, suites.Suites, 1)
+	suite := suites.Suites[0]
+	require.Equal(t, "testApp (web)", suite.Name)
+	require.Equal(t, 4, suite.Tests)
+	require.Equal(t, 1, suite.Failures)
+
+	require.Equal(t, "instance 0", suite.Cases[0].Name)
+	require.Equal(t, "testApp (web)", suite.Cases[0].ClassName)
+	require.Nil(t, suite.Cases[0].Failure)
+	require.Equal(t, "instance 1", suite.Cases[1].Name)
+	require.Contains(t, suite.Cases[1].Failure.Message, "Did not restart within")
+	require.Equal(t, exitCode, 1)
+}
+
+func TestJUnitReport_AppFailure(t *testing.T) {
+	r := newRunReport()
+	r.addFailedApp("testApp", "", &testError{1, "App testApp not found"})
+
+	suites := junitReport(r)
+
+	require.Len(t, suites.Suites, 1)
+	require.Equal(t, 1, suites.Suites[0].Tests)
+	require.Equal(t, 1, suites.Suites[0].Failures)
+	require.Equal(t, "restart", suites.Suites[0].Cases[0].Name)
+	require.Equal(t, "App testApp not found", suites.Suites[0].Cases[0].Failure.Message)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restartPlan describes how the instances of a process are going to be
+// restarted, so the same plan can be carried out or printed for --dry-run.
+type restartPlan struct {
+	originalCount int
+	surge         int
+	canaryID      string
+	batchSize     int
+	batches       [][]string
+	skipped       []skippedInstance
+}
+
+// skippedInstance is an instance that is left alone and the reason why.
+type skippedInstance struct {
+	instanceID string
+	reason     string
+}
+
+// selectInstances splits the instances of the target into the ones to restart
+// and the ones to skip, which are the instances that were already restarted
+// when resuming a rollout, the ones left out of --instances, the healthy ones
+// with --only-unhealthy and those that are not older than --older-than. The
+// instances to restart are put in the --order.
+func selectInstances(t target, instances Instances) ([]string, []skippedInstance) {
+	var selected []string
+	var skipped []skippedInstance
+
+	for _, instanceID := range selectedInstances {
+		if _, found := instances[instanceID]; !found {
+			printFormatted("Instance %s of %s was selected with --instances but does not exist.\n", instanceID, t)
+		}
+	}
+
+	for _, instanceID := range getKeysFor(instances) {
+		instance := instances[instanceID]
+		if selectedInstances != nil && !containsString(selectedInstances, instanceID) {
+			skipped = append(skipped, skippedInstance{instanceID, "it was not selected with --instances"})
+			continue
+		}
+
+		if restarted, done := t.state.alreadyRestarted(t.processType, instanceID, instance); done {
+			skipped = append(skipped, skippedInstance{instanceID, "already restarted at " + restarted.Format(time.RFC3339)})
+			continue
+		}
+
+		if onlyUnhealthy && !isInstanceUnhealthy(instance) {
+			skipped = append(skipped, skippedInstance{instanceID, "it is " + instance.State})
+			continue
+		}
+
+		if uptime := time.Duration(instance.Uptime) * time.Second; olderThan > 0 && uptime < olderThan {
+			skipped = append(skipped, skippedInstance{instanceID, fmt.Sprintf("up for %s, which is not older than %s", uptime, olderThan)})
+			continue
+		}
+
+		selected = append(selected, instanceID)
+	}
+
+	selected = orderInstances(selected, instances)
+	if spreadBy == cellSpread {
+		selected = spreadAcrossCells(selected, instances)
+	}
+	return selected, skipped
+}
+
+// orderInstances puts the instance IDs, which are in numeric order, in the
+// order given with --order.
+func orderInstances(instanceIDs []string, instances Instances) []string {
+	switch instanceOrder {
+	case reverseOrder:
+		for i, j := 0, len(instanceIDs)-1; i < j; i, j = i+1, j-1 {
+			instanceIDs[i], instanceIDs[j] = instanceIDs[j], instanceIDs[i]
+		}
+	case randomOrder:
+		for i := len(instanceIDs) - 1; i > 0; i-- {
+			j := int(random() * float64(i+1))
+			instanceIDs[i], instanceIDs[j] = instanceIDs[j], instanceIDs[i]
+		}
+	case oldestFirstOrder:
+		sort.SliceStable(instanceIDs, func(i, j int) bool {
+			return instances[instanceIDs[i]].Uptime > instances[instanceIDs[j]].Uptime
+		})
+	}
+	return instanceIDs
+}
+
+// maxInstanceIndex bounds the indexes given with --instances, so that a range
+// such as 0-2147483647 is rejected rather than expanded.
+const maxInstanceIndex = 9999
+
+// parseInstanceList expands a list of instance indexes and ranges such as
+// 0,3,5-9 into the instance IDs in numeric order.
+func parseInstanceList(list string) ([]string, error) {
+	indexes := map[int]bool{}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("The instance list %q is invalid, expected indexes and ranges such as 0,3,5-9, please try again.", list)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("The instance list %q is invalid, expected indexes and ranges such as 0,3,5-9, please try again.", list)
+			}
+		}
+
+		if last > maxInstanceIndex {
+			return nil, fmt.Errorf("The instance list %q is invalid, instance indexes can not be higher than %d, please try again.", list, maxInstanceIndex)
+		}
+
+		for index := first; index <= last; index++ {
+			indexes[index] = true
+		}
+	}
+
+	var sorted []int
+	for index := range indexes {
+		sorted = append(sorted, index)
+	}
+	sort.Ints(sorted)
+
+	instanceIDs := make([]string, len(sorted))
+	for i, index := range sorted {
+		instanceIDs[i] = strconv.Itoa(index)
+	}
+	return instanceIDs, nil
+}
+
+// planRestart works out the scale up, canary and batches for the instances
+// of the target that are restarted. The skipped instances still count towards
+// the batch size and towards whether the process has to be scaled up.
+func planRestart(t target, instances Instances) restartPlan {
+	instanceIDs, skipped := selectInstances(t, instances)
+
+	count := len(instanceIDs) + len(skipped)
+	plan := restartPlan{
+		originalCount: count,
+		batchSize:     getBatchSize(count),
+		skipped:       skipped,
+	}
+
+	// A single instance is always surged by one, so that one instance of the
+	// app stays up while it is restarted.
+	if len(instanceIDs) > 0 {
+		plan.surge = surge
+		if plan.surge == 0 && count < 2 {
+			plan.surge = 1
+		}
+	}
+
+	// The batches are no larger than an explicit --surge, so the capacity
+	// never drops below the original instance count.
+	if surge > 0 && plan.batchSize > surge {
+		plan.batchSize = surge
+	}
+
+	if canary && len(instanceIDs) > 0 {
+		plan.canaryID = instanceIDs[0]
+		instanceIDs = instanceIDs[1:]
+	}
+
+	if spreadBy == zoneSpread {
+		plan.batches = splitByZone(instanceIDs, instances, plan.batchSize)
+	} else {
+		plan.batches = splitIntoBatches(instanceIDs, plan.batchSize)
+	}
+	return plan
+}
+
+// spreadAcrossCells interleaves the instances so that, as far as possible, no
+// two instances on the same Diego cell are restarted back to back. The order
+// of the instances on each cell is kept.
+func spreadAcrossCells(instanceIDs []string, instances Instances) []string {
+	var hosts []string
+	byHost := map[string][]string{}
+	for _, instanceID := range instanceIDs {
+		host := instances[instanceID].Host
+		if _, found := byHost[host]; !found {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], instanceID)
+	}
+
+	spread := make([]string, 0, len(instanceIDs))
+	for len(spread) < len(instanceIDs) {
+		for _, host := range hosts {
+			if len(byHost[host]) > 0 {
+				spread = append(spread, byHost[host][0])
+				byHost[host] = byHost[host][1:]
+			}
+		}
+	}
+	return spread
+}
+
+// splitByZone splits the instances into batches that each stay within a
+// single availability zone, alternating between the zones so that only one
+// zone is ever degraded at a time.
+func splitByZone(instanceIDs []string, instances Instances, size int) [][]string {
+	var zones []string
+	byZone := map[string][]string{}
+	for _, instanceID := range instanceIDs {
+		zone := instances[instanceID].Zone
+		if _, found := byZone[zone]; !found {
+			zones = append(zones, zone)
+		}
+		byZone[zone] = append(byZone[zone], instanceID)
+	}
+
+	total := 0
+	zoneBatches := make([][][]string, len(zones))
+	for i, zone := range zones {
+		zoneBatches[i] = splitIntoBatches(byZone[zone], size)
+		total += len(zoneBatches[i])
+	}
+
+	batches := make([][]string, 0, total)
+	for round := 0; len(batches) < total; round++ {
+		for _, batchesInZone := range zoneBatches {
+			if round < len(batchesInZone) {
+				batches = append(batches, batchesInZone[round])
+			}
+		}
+	}
+	return batches
+}
+
+// surgeIDs lists the instances added when the process is scaled up.
+func (plan restartPlan) surgeIDs() []string {
+	surgeIDs := make([]string, plan.surge)
+	for i := range surgeIDs {
+		surgeIDs[i] = strconv.Itoa(plan.originalCount + i)
+	}
+	return surgeIDs
+}
+
+// instanceIDs lists every instance the plan restarts, in order.
+func (plan restartPlan) instanceIDs() []string {
+	var instanceIDs []string
+	if plan.canaryID != "" {
+		instanceIDs = append(instanceIDs, plan.canaryID)
+	}
+	for _, batch := range plan.batches {
+		instanceIDs = append(instanceIDs, batch...)
+	}
+	return instanceIDs
+}
+
+// minHealthy returns how many of the other instances --min-healthy requires to
+// be running before an instance is restarted, and how many at most can be,
+// which are the instances that are not restarted in the same batch.
+func (plan restartPlan) minHealthy() (required int, available int) {
+	if minHealthy == 0 || len(plan.instanceIDs()) == 0 {
+		return 0, 0
+	}
+
+	largest := 1
+	for _, batch := range plan.batches {
+		if len(batch) > largest {
+			largest = len(batch)
+		}
+	}
+
+	count := plan.originalCount + plan.surge
+	return getMinHealthy(count - 1), count - largest
+}
+
+// estimatedDuration is the longest the plan can take before every instance
+// has either come back or timed out.
+func (plan restartPlan) estimatedDuration() time.Duration {
+	waits := len(plan.batches)
+	if plan.surge > 0 {
+		waits++
+	}
+
+	estimate := time.Duration(waits) * maxWait(stableFor)
+	if plan.canaryID != "" {
+		estimate += maxWait(stableFor) + canarySoak
+	}
+
+	return estimate
+}
+
+// printPlan outputs the plan for a --dry-run.
+func printPlan(t target, plan restartPlan) {
+	printFormatted("Restart plan for %s:\n", t)
+
+	for _, skip := range plan.skipped {
+		printFormatted("  Skip instance %s, %s.\n", skip.instanceID, skip.reason)
+	}
+
+	if plan.surge > 0 {
+		printFormatted("  Scale %s up to %s and wait for %s.\n", t, describeCount(plan.originalCount+plan.surge), describeInstances(plan.surgeIDs()))
+	}
+
+	if plan.canaryID != "" {
+		printFormatted("  Restart instance %s as a canary and watch it for %s.\n", plan.canaryID, canarySoak)
+	}
+
+	for i, batch := range plan.batches {
+		printFormatted("  Batch %d: restart %s.\n", i+1, describeInstances(batch))
+	}
+
+	if plan.surge > 0 {
+		printFormatted("  Scale %s back down to %s.\n", t, describeCount(plan.originalCount))
+	}
+
+	printFormatted("  Estimated time: up to %s.\n", plan.estimatedDuration())
+}
+
+// printInterrupted outputs which of the planned instances were restarted
+// before the rollout was interrupted and which were left alone.
+func printInterrupted(t target, plan restartPlan, restarted []string) {
+	printFormatted("The restart of %s was interrupted.\n", t)
+
+	var skipped []string
+	for _, instanceID := range plan.instanceIDs() {
+		if !containsString(restarted, instanceID) {
+			skipped = append(skipped, instanceID)
+		}
+	}
+
+	if len(restarted) > 0 {
+		printFormatted("  Restarted %s.\n", describeInstances(restarted))
+	}
+	if len(skipped) > 0 {
+		printFormatted("  Did not restart %s.\n", describeInstances(skipped))
+	}
+}
+
+// describeCount describes a number of instances, spelling out the counts that
+// come up when a single instance is scaled up.
+func describeCount(count int) string {
+	switch count {
+	case 1:
+		return "one instance"
+	case 2:
+		return "two instances"
+	}
+	return fmt.Sprintf("%d instances", count)
+}
+
+func describeInstances(instanceIDs []string) string {
+	if len(instanceIDs) == 1 {
+		return "instance " + instanceIDs[0]
+	}
+	return "instances " + strings.Join(instanceIDs, ", ")
+}
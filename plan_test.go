@@ -0,0 +1,294 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_DryRun_SingleAppInstance(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--max-cycles", "60", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, 3, cliConn.CliCommandWithoutTerminalOutputCallCount())
+
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Scale testApp up to two instances and wait for instance 1.\n",
+		"  Batch 1: restart instance 0.\n",
+		"  Scale testApp back down to one instance.\n",
+		"  Estimated time: up to 2m0s.\n",
+	}, output)
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_DryRun_CanaryAndBatches(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--max-cycles", "60", "--canary", "--canary-soak", "30s", "--batch-size", "2", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Restart instance 0 as a canary and watch it for 30s.\n",
+		"  Batch 1: restart instances 1, 2.\n",
+		"  Batch 2: restart instance 3.\n",
+		"  Estimated time: up to 3m30s.\n",
+	}, output)
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_DryRun_OlderThan(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, agedInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--older-than", "336h", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Skip instance 1, up for 5s, which is not older than 336h0m0s.\n",
+		"  Skip instance 3, up for 1h0m0s, which is not older than 336h0m0s.\n",
+		"  Batch 1: restart instance 0.\n",
+		"  Batch 2: restart instance 2.\n",
+	}, output[:5])
+}
+
+func TestRollingRestart_Run_Success_OlderThan(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(agedInstanceResponse, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--older-than", "336h", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "2"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, "Skipping instance 1 of testApp, up for 5s, which is not older than 336h0m0s.\n", output[0])
+}
+
+func TestRollingRestart_Run_OlderThanSkipsEveryInstance(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, agedInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--older-than", "1000h", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{
+		"Skipping instance 0 of testApp, up for 361h6m40s, which is not older than 1000h0m0s.\n",
+		"Skipping instance 1 of testApp, up for 5s, which is not older than 1000h0m0s.\n",
+		"Skipping instance 2 of testApp, up for 336h0m1s, which is not older than 1000h0m0s.\n",
+		"Skipping instance 3 of testApp, up for 1h0m0s, which is not older than 1000h0m0s.\n",
+		"No instances of testApp need to be restarted.\n",
+	}, output)
+}
+
+func TestRollingRestart_Run_DryRun_InstancesAndOrder(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--instances", "1-3,12", "--order", "reverse", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{
+		"Instance 12 of testApp was selected with --instances but does not exist.\n",
+		"Restart plan for testApp:\n",
+		"  Skip instance 0, it was not selected with --instances.\n",
+		"  Batch 1: restart instance 3.\n",
+		"  Batch 2: restart instance 2.\n",
+		"  Batch 3: restart instance 1.\n",
+	}, output[:6])
+}
+
+func TestRollingRestart_Run_UnknownOrder(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--order", "alphabetical", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output[0], "Unknown --order \"alphabetical\"")
+}
+
+func TestGetKeysFor_NumericOrder(t *testing.T) {
+	instances := Instances{}
+	for _, instanceID := range []string{"10", "2", "1", "0", "11", "3"} {
+		instances[instanceID] = Instance{}
+	}
+
+	require.Equal(t, []string{"0", "1", "2", "3", "10", "11"}, getKeysFor(instances))
+}
+
+func TestParseInstanceList(t *testing.T) {
+	instanceIDs, err := parseInstanceList("7, 0,3,5-9")
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "3", "5", "6", "7", "8", "9"}, instanceIDs)
+
+	for _, list := range []string{"a", "1,", "9-5", "-1", "2-x", "10000", "0-2147483647"} {
+		_, err = parseInstanceList(list)
+		require.Error(t, err, list)
+	}
+
+	instanceIDs, err = parseInstanceList("9998-9999")
+	require.NoError(t, err)
+	require.Equal(t, []string{"9998", "9999"}, instanceIDs)
+}
+
+func TestOrderInstances(t *testing.T) {
+	oldInstanceOrder := instanceOrder
+	defer func() { instanceOrder = oldInstanceOrder }()
+
+	oldRandom := random
+	defer func() { random = oldRandom }()
+	random = func() float64 { return 0 }
+
+	instances := Instances{"0": {Uptime: 5}, "1": {Uptime: 500}, "2": {Uptime: 50}, "3": {Uptime: 500}}
+
+	instanceOrder = reverseOrder
+	require.Equal(t, []string{"3", "2", "1", "0"}, orderInstances([]string{"0", "1", "2", "3"}, instances))
+
+	instanceOrder = randomOrder
+	require.Equal(t, []string{"1", "2", "3", "0"}, orderInstances([]string{"0", "1", "2", "3"}, instances))
+
+	instanceOrder = oldestFirstOrder
+	require.Equal(t, []string{"1", "3", "2", "0"}, orderInstances([]string{"0", "1", "2", "3"}, instances))
+}
+
+func TestRollingRestart_Run_DryRun_SpreadByZone(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(zonedStatsResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--spread-by", "zone", "--batch-size", "2", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Batch 1: restart instances 0, 2.\n",
+		"  Batch 2: restart instances 1, 3.\n",
+	}, output[:3])
+}
+
+func TestRollingRestart_Run_DryRun_SpreadByCell(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(zonedStatsResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--spread-by", "cell", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Batch 1: restart instance 0.\n",
+		"  Batch 2: restart instance 2.\n",
+		"  Batch 3: restart instance 1.\n",
+		"  Batch 4: restart instance 3.\n",
+	}, output[:5])
+}
+
+func TestRollingRestart_Run_SpreadByZoneWithoutZones(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--spread-by", "zone", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Failed to spread the restart of testApp across availability zones.\n", output[0])
+	require.Equal(t, "The foundation does not report the availability zone of instance 0.\n", output[1])
+}
+
+func TestRollingRestart_Run_SpreadByRequiresV3(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--spread-by", "cell", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output[0], "requires the V3 API")
+}
+
+func TestSplitByZone(t *testing.T) {
+	instances := Instances{"0": {Zone: "a"}, "1": {Zone: "a"}, "2": {Zone: "a"}, "3": {Zone: "b"}, "4": {Zone: "b"}, "5": {Zone: "c"}}
+
+	require.Equal(t, [][]string{{"0", "1"}, {"3", "4"}, {"5"}, {"2"}}, splitByZone([]string{"0", "1", "2", "3", "4", "5"}, instances, 2))
+}
+
+func TestSpreadAcrossCells(t *testing.T) {
+	instances := Instances{"0": {Host: "a"}, "1": {Host: "a"}, "2": {Host: "a"}, "3": {Host: "b"}, "4": {Host: "c"}}
+
+	require.Equal(t, []string{"0", "3", "4", "1", "2"}, spreadAcrossCells([]string{"0", "1", "2", "3", "4"}, instances))
+}
+
+func TestRollingRestart_Run_DryRun_Surge(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--max-cycles", "60", "--surge", "2", "--batch-size", "3", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{
+		"Restart plan for testApp:\n",
+		"  Scale testApp up to 6 instances and wait for instances 4, 5.\n",
+		"  Batch 1: restart instances 0, 1.\n",
+		"  Batch 2: restart instances 2, 3.\n",
+		"  Scale testApp back down to 4 instances.\n",
+		"  Estimated time: up to 3m0s.\n",
+	}, output)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// random returns a number in [0, 1) used to add jitter to the backoff.
+var random = rand.Float64
+
+// The default source is only seeded on its own from Go 1.20 on, seed it so
+// that the jitter differs between runs on the Go release CI builds with.
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// pollSchedule paces the status polls of a single wait. It gives up once the
+// --timeout has passed, or after --max-cycles polls when no timeout is set,
+// and waits --poll-interval between polls. With --backoff the interval
+// doubles after every poll up to --max-poll-interval.
+type pollSchedule struct {
+	deadline time.Time
+	cycles   int
+	polls    int
+	interval time.Duration
+}
+
+// newPollSchedule starts a schedule whose limit is extended by extra, which
+// is how the --stable-for window is added on top of the timeout.
+func newPollSchedule(extra time.Duration) *pollSchedule {
+	schedule := &pollSchedule{interval: pollInterval}
+	if waitTimeout > 0 {
+		schedule.deadline = now().Add(waitTimeout + extra)
+	} else {
+		schedule.cycles = maxRestartWaitCycles + int(extra/pollInterval)
+	}
+	return schedule
+}
+
+// next reports whether another poll is due and counts it.
+func (s *pollSchedule) next() bool {
+	if s.deadline.IsZero() && s.polls >= s.cycles {
+		return false
+	}
+
+	if !s.deadline.IsZero() && s.polls > 0 && !now().Before(s.deadline) {
+		return false
+	}
+
+	s.polls++
+	return true
+}
+
+// wait sleeps until the next poll is due, or until the context is cancelled.
+func (s *pollSchedule) wait(ctx context.Context) error {
+	delay := s.interval
+	if backoff {
+		// Wait between half and all of the interval so that parallel
+		// rollouts do not poll the cloud controller in lockstep.
+		delay = delay/2 + time.Duration(random()*float64(delay/2))
+		if s.interval *= 2; s.interval > maxPollInterval {
+			s.interval = maxPollInterval
+		}
+	}
+
+	if !s.deadline.IsZero() {
+		if remaining := s.deadline.Sub(now()); remaining < delay {
+			delay = remaining
+		}
+	}
+
+	if delay > 0 {
+		return sleep(ctx, delay)
+	}
+	return ctx.Err()
+}
+
+// maxWait is the longest a single wait can take before it times out, leaving
+// the jitter aside.
+func maxWait(extra time.Duration) time.Duration {
+	if waitTimeout > 0 {
+		return waitTimeout + extra
+	}
+
+	var total time.Duration
+	interval := pollInterval
+	for i := 0; i < maxRestartWaitCycles+int(extra/pollInterval); i++ {
+		total += interval
+		if backoff {
+			if interval *= 2; interval > maxPollInterval {
+				interval = maxPollInterval
+			}
+		}
+	}
+	return total
+}
+
+// describeWaitLimit explains how long the plugin waits for an instance. The
+// cycle count is kept as seconds when polling once a second, as it always
+// used to be.
+func describeWaitLimit() string {
+	if waitTimeout == 0 && pollInterval == time.Second && !backoff {
+		return fmt.Sprintf("%d Second(s)", maxRestartWaitCycles)
+	}
+	return maxWait(0).String()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_InstanceDoesNotRestartWithinTimeout(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, alwaysRestartingResponse)
+	setupCliCommandStub(true, true)
+	rr.Run(cliConn, []string{"rolling-restart", "--timeout", "10s", "--poll-interval", "3s", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output[1], "Checking status of instance 0.")
+	require.Contains(t, output[2], "Application did not restart within 10s, failing out. Check your current application state.")
+}
+
+func TestRollingRestart_Run_LongPollIntervalSeesRestartedInstances(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	running := []string{`{"0": {"state": "RUNNING", "uptime": 5000}, "1": {"state": "RUNNING", "uptime": 5000}}`}
+	down := []string{`{"0": {"state": "DOWN", "uptime": 0}, "1": {"state": "RUNNING", "uptime": 5000}}`}
+	restarted := []string{`{"0": {"state": "RUNNING", "uptime": 15}, "1": {"state": "RUNNING", "uptime": 15}}`}
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(running, running, down, restarted)
+	setupCliCommandStub(true, true)
+	rr.Run(cliConn, []string{"rolling-restart", "--timeout", "2m", "--poll-interval", "20s", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, "Finished restart of app instances for testApp.\n", output[len(output)-1])
+}
+
+func TestIsInstanceRunning_StartedAfterTheRestartWasRequested(t *testing.T) {
+	requested := fakeNow.Add(-30 * time.Second)
+
+	require.True(t, isInstanceRunning(Instance{State: "RUNNING", Uptime: 25}, requested))
+	require.True(t, isInstanceRunning(Instance{State: "RUNNING", Uptime: 5000, Since: int(requested.Unix())}, requested))
+	require.False(t, isInstanceRunning(Instance{State: "RUNNING", Uptime: 45}, requested))
+	require.False(t, isInstanceRunning(Instance{State: "STARTING", Uptime: 0}, requested))
+}
+
+func TestRollingRestart_Run_MaxCyclesAndTimeout(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "1", "--timeout", "1m", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output[0], "Only one of --max-cycles and --timeout may be provided")
+}
+
+func TestPollSchedule_StopsAtTimeout(t *testing.T) {
+	defer setPolling(10*time.Second, 3*time.Second, false)()
+
+	start := fakeNow
+	schedule := newPollSchedule(0)
+	polls := 0
+	for schedule.next() {
+		polls++
+		schedule.wait(context.Background())
+	}
+
+	require.Equal(t, 4, polls)
+	require.Equal(t, 10*time.Second, fakeNow.Sub(start))
+}
+
+func TestPollSchedule_StopsAfterMaxCycles(t *testing.T) {
+	defer setPolling(0, 2*time.Second, false)()
+
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+	maxRestartWaitCycles = 3
+
+	schedule := newPollSchedule(4 * time.Second)
+	polls := 0
+	for schedule.next() {
+		polls++
+	}
+
+	require.Equal(t, 5, polls)
+	require.Equal(t, 10*time.Second, maxWait(4*time.Second))
+}
+
+func TestPollSchedule_BacksOffWithJitter(t *testing.T) {
+	defer setPolling(time.Minute, time.Second, true)()
+
+	oldRandom := random
+	defer func() { random = oldRandom }()
+	random = func() float64 { return 0.5 }
+
+	var delays []time.Duration
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return sleepStub(ctx, d)
+	}
+
+	schedule := newPollSchedule(0)
+	for i := 0; i < 5; i++ {
+		schedule.wait(context.Background())
+	}
+
+	require.Equal(t, []time.Duration{
+		750 * time.Millisecond,
+		1500 * time.Millisecond,
+		3 * time.Second,
+		3750 * time.Millisecond,
+		3750 * time.Millisecond,
+	}, delays)
+}
+
+func TestMaxWait_Backoff(t *testing.T) {
+	defer setPolling(0, time.Second, true)()
+
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+	maxRestartWaitCycles = 5
+
+	require.Equal(t, 1*time.Second+2*time.Second+4*time.Second+5*time.Second+5*time.Second, maxWait(0))
+	require.Equal(t, "17s", describeWaitLimit())
+}
+
+// setPolling sets the polling options with a five second backoff limit and
+// returns a function restoring the previous ones.
+func setPolling(timeout, interval time.Duration, backingOff bool) func() {
+	oldTimeout, oldInterval, oldBackoff, oldMaxInterval := waitTimeout, pollInterval, backoff, maxPollInterval
+	waitTimeout, pollInterval, backoff, maxPollInterval = timeout, interval, backingOff, 5*time.Second
+	return func() {
+		waitTimeout, pollInterval, backoff, maxPollInterval = oldTimeout, oldInterval, oldBackoff, oldMaxInterval
+	}
+}
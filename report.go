@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Results used in the machine readable report.
+const (
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+	resultPlanned   = "planned"
+)
+
+// runReport is the document written at the end of a run for --output json.
+type runReport struct {
+	mutex  sync.Mutex
+	Result string       `json:"result"`
+	Apps   []*appReport `json:"apps"`
+}
+
+// appReport holds the outcome of restarting one process of an application.
+// Errors that happen before the processes are known are reported without a
+// process.
+type appReport struct {
+	App       string            `json:"app"`
+	GUID      string            `json:"guid,omitempty"`
+	Process   string            `json:"process,omitempty"`
+	Instances []*instanceReport `json:"instances"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// instanceReport holds the outcome of restarting a single instance.
+type instanceReport struct {
+	Index      string     `json:"index"`
+	Started    time.Time  `json:"restart_started"`
+	Finished   *time.Time `json:"restart_finished,omitempty"`
+	WaitCycles int        `json:"wait_cycles"`
+	Result     string     `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// newRunReport returns an empty report for a run.
+func newRunReport() *runReport {
+	return &runReport{Apps: []*appReport{}}
+}
+
+// addApp starts the report for an application process.
+func (r *runReport) addApp(appName string, appGUID string, processType string) *appReport {
+	app := &appReport{App: appName, GUID: appGUID, Process: processType, Instances: []*instanceReport{}}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Apps = append(r.Apps, app)
+	return app
+}
+
+// addFailedApp reports an application that failed before any of its
+// processes could be restarted.
+func (r *runReport) addFailedApp(appName string, appGUID string, err error) {
+	app := r.addApp(appName, appGUID, "")
+	app.Result = resultFailed
+	app.Error = err.Error()
+}
+
+// write outputs the report as an indented JSON document.
+func (r *runReport) write(writer io.Writer, exitCode int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Result = resultSucceeded
+	if exitCode != successfulExit {
+		r.Result = resultFailed
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// startInstance records that the restart of an instance was requested. All
+// appReport methods are no-ops on a nil report.
+func (a *appReport) startInstance(instanceID string) {
+	if a == nil {
+		return
+	}
+	a.Instances = append(a.Instances, &instanceReport{Index: instanceID, Started: now()})
+}
+
+// instance returns the report of the most recent restart of an instance, or
+// nil when the instance has not been restarted.
+func (a *appReport) instance(instanceID string) *instanceReport {
+	if a == nil {
+		return nil
+	}
+
+	for i := len(a.Instances) - 1; i >= 0; i-- {
+		if a.Instances[i].Index == instanceID {
+			return a.Instances[i]
+		}
+	}
+	return nil
+}
+
+// finishBatch records the result of every instance of the batch that was
+// restarted.
+func (a *appReport) finishBatch(batch []string, failures []instanceFailure) {
+	reasons := map[string]string{}
+	for _, failure := range failures {
+		reasons[failure.instanceID] = failure.reason
+	}
+
+	for _, instanceID := range batch {
+		if reason, failed := reasons[instanceID]; failed {
+			a.instance(instanceID).fail(reason)
+		} else {
+			a.instance(instanceID).succeed()
+		}
+	}
+}
+
+// finish records the result of the whole process.
+func (a *appReport) finish(exitCode int) {
+	if a == nil {
+		return
+	}
+
+	switch {
+	case exitCode != successfulExit:
+		a.Result = resultFailed
+	case dryRun:
+		a.Result = resultPlanned
+	default:
+		a.Result = resultSucceeded
+	}
+}
+
+func (i *instanceReport) countCycle() {
+	if i != nil {
+		i.WaitCycles++
+	}
+}
+
+func (i *instanceReport) succeed() {
+	if i != nil && i.Result == "" {
+		finished := now()
+		i.Finished = &finished
+		i.Result = resultSucceeded
+	}
+}
+
+func (i *instanceReport) fail(reason string) {
+	if i != nil {
+		finished := now()
+		i.Finished = &finished
+		i.Result = resultFailed
+		i.Error = reason
+	}
+}
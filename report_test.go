@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_JSONOutput(t *testing.T) {
+	var jsonBuffer, logBuffer bytes.Buffer
+	oldStdout, oldStderr := stdout, stderr
+	defer func() { stdout, stderr = oldStdout, oldStderr }()
+	stdout, stderr = &jsonBuffer, &logBuffer
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--output", "json", "--on-failure", "continue", "testApp"})
+
+	var result struct {
+		Result string `json:"result"`
+		Apps   []struct {
+			App       string `json:"app"`
+			GUID      string `json:"guid"`
+			Process   string `json:"process"`
+			Result    string `json:"result"`
+			Instances []struct {
+				Index      string  `json:"index"`
+				Started    string  `json:"restart_started"`
+				Finished   *string `json:"restart_finished"`
+				WaitCycles int     `json:"wait_cycles"`
+				Result     string  `json:"result"`
+				Error      string  `json:"error"`
+			} `json:"instances"`
+		} `json:"apps"`
+	}
+	require.NoError(t, json.Unmarshal(jsonBuffer.Bytes(), &result))
+
+	require.Equal(t, "failed", result.Result)
+	require.Len(t, result.Apps, 1)
+	require.Equal(t, "testApp", result.Apps[0].App)
+	require.Equal(t, "valid-app-guid", result.Apps[0].GUID)
+	require.Equal(t, "web", result.Apps[0].Process)
+	require.Equal(t, "failed", result.Apps[0].Result)
+
+	instances := result.Apps[0].Instances
+	require.Len(t, instances, 4)
+	require.Equal(t, "0", instances[0].Index)
+	require.Equal(t, "succeeded", instances[0].Result)
+	require.Equal(t, 1, instances[0].WaitCycles)
+	require.NotNil(t, instances[0].Finished)
+	require.Equal(t, "1", instances[1].Index)
+	require.Equal(t, "failed", instances[1].Result)
+	require.Contains(t, instances[1].Error, "Did not restart within")
+
+	require.Empty(t, output)
+	require.Contains(t, logBuffer.String(), "Beginning restart of app instances for testApp.")
+	require.Equal(t, 1, exitCode)
+}
+
+func TestRollingRestart_Run_JSONOutputReportsAppFailures(t *testing.T) {
+	var jsonBuffer bytes.Buffer
+	oldStdout, oldStderr := stdout, stderr
+	defer func() { stdout, stderr = oldStdout, oldStderr }()
+	stdout, stderr = &jsonBuffer, &bytes.Buffer{}
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(false, true, twoInstanceResponse)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--output", "json", "testApp"})
+
+	require.JSONEq(t, `{"result": "failed", "apps": [{"app": "testApp", "instances": [], "result": "failed", "error": "CliCommandWithoutTerminalStubError"}]}`, jsonBuffer.String())
+	require.Equal(t, 1, exitCode)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/cloudfoundry/cli/plugin"
+)
+
+// packageList is a page of the V3 packages endpoint.
+type packageList struct {
+	Resources []struct {
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	} `json:"resources"`
+}
+
+// build is a V3 build, which stages a package into a droplet.
+type build struct {
+	GUID    string `json:"guid"`
+	State   string `json:"state"`
+	Error   string `json:"error"`
+	Droplet *struct {
+		GUID string `json:"guid"`
+	} `json:"droplet"`
+}
+
+// deployment is a V3 deployment, which replaces the instances of an app with
+// instances running another droplet.
+type deployment struct {
+	GUID   string `json:"guid"`
+	State  string `json:"state"`
+	Status struct {
+		Value  string `json:"value"`
+		Reason string `json:"reason"`
+	} `json:"status"`
+}
+
+// finished reports whether the deployment stopped replacing instances. Older
+// foundations only report the state of the deployment.
+func (d deployment) finished() bool {
+	return d.Status.Value == "FINALIZED" || d.State == "DEPLOYED" || d.State == "CANCELED"
+}
+
+// outcome is how the deployment finished, e.g. DEPLOYED or CANCELED.
+func (d deployment) outcome() string {
+	if d.Status.Reason != "" {
+		return d.Status.Reason
+	}
+	return d.State
+}
+
+// restageApp stages a new droplet from the latest package of the app and
+// rolls it out with a rolling deployment, which replaces the instances one at
+// a time. The staged droplet is saved with the progress of the app, so that
+// --resume rolls it out again without staging another one.
+func restageApp(ctx context.Context, conn plugin.CliConnection, appName string, appGUID string) (exitCode int) {
+	state, err := startRollout(appName, appGUID)
+	if err != nil {
+		printFormatted("Failed to load the saved progress of %s.\n", appName)
+		printError(err.Error())
+		report.addFailedApp(appName, appGUID, err)
+		return failureExit
+	}
+
+	var dropletGUID string
+	if state != nil && state.resumed {
+		dropletGUID = state.Droplet
+	}
+
+	switch {
+	case dryRun && dropletGUID != "":
+		printFormatted("Roll out droplet %s of %s, staged by the resumed run, with a rolling deployment.\n", dropletGUID, appName)
+	case dryRun:
+		printFormatted("Stage a new droplet for %s from its latest package and roll it out with a rolling deployment.\n", appName)
+	case dropletGUID != "":
+		printFormatted("Skipping staging of %s, droplet %s was staged by the resumed run.\n", appName, dropletGUID)
+	default:
+		if dropletGUID, err = stageDroplet(ctx, conn, appName, appGUID); err != nil {
+			printFormatted("Failed to stage a new droplet for %s.\n", appName)
+			printError(err.Error())
+			report.addFailedApp(appName, appGUID, err)
+			return failureExit
+		}
+
+		if err = state.recordDroplet(dropletGUID); err != nil {
+			printFormatted("Failed to save the progress of %s: %s\n", appName, err)
+		}
+	}
+
+	if dryRun {
+		report.addApp(appName, appGUID, "").finish(successfulExit)
+		return successfulExit
+	}
+
+	if err = deployDroplet(ctx, conn, appName, appGUID, dropletGUID); err != nil {
+		printFormatted("Failed to roll out droplet %s to %s.\n", dropletGUID, appName)
+		printError(err.Error())
+		report.addFailedApp(appName, appGUID, err)
+		return failureExit
+	}
+	report.addApp(appName, appGUID, "").finish(successfulExit)
+
+	if err = state.remove(); err != nil {
+		printFormatted("Failed to remove the saved progress of %s: %s\n", appName, err)
+	}
+
+	return successfulExit
+}
+
+// stageDroplet stages a new droplet from the latest package of the app,
+// returning the GUID of the droplet.
+func stageDroplet(ctx context.Context, conn plugin.CliConnection, appName string, appGUID string) (dropletGUID string, err error) {
+	events.emit(event{Event: eventStagingStarted, App: appName, GUID: appGUID})
+	defer func() {
+		events.emit(event{Event: eventStagingFinished, App: appName, GUID: appGUID, Error: errorMessage(err)})
+	}()
+
+	var packageGUID string
+	if packageGUID, err = getLatestPackage(conn, appGUID); err != nil {
+		return "", err
+	}
+
+	printFormatted("Staging a new droplet for %s.\n", appName)
+
+	var staged build
+	if staged, err = createBuild(conn, packageGUID); err != nil {
+		return "", err
+	}
+
+	deadline := now().Add(stagingTimeout)
+	for staged.State != "STAGED" {
+		if staged.State == "FAILED" {
+			return "", fmt.Errorf("Staging failed: %s", staged.Error)
+		}
+
+		if !now().Before(deadline) {
+			return "", fmt.Errorf("Staging did not finish within %s.", stagingTimeout)
+		}
+
+		spinner.Next()
+		if err = sleep(ctx, pollInterval); err != nil {
+			return "", err
+		}
+
+		if staged, err = getBuild(conn, staged.GUID); err != nil {
+			return "", err
+		}
+	}
+	spinner.Done()
+
+	if staged.Droplet == nil {
+		return "", errors.New("The staged build did not report its droplet.")
+	}
+
+	printFormatted("Finished staging droplet %s for %s.\n", staged.Droplet.GUID, appName)
+	return staged.Droplet.GUID, nil
+}
+
+// deployDroplet rolls the droplet out with a rolling deployment, which also
+// makes it the current droplet of the app, and waits up to
+// --deployment-timeout for the deployment to replace every instance.
+func deployDroplet(ctx context.Context, conn plugin.CliConnection, appName string, appGUID string, dropletGUID string) (err error) {
+	events.emit(event{Event: eventDeploymentStarted, App: appName, GUID: appGUID})
+	defer func() {
+		events.emit(event{Event: eventDeploymentFinished, App: appName, GUID: appGUID, Error: errorMessage(err)})
+	}()
+
+	printFormatted("Rolling out droplet %s to %s.\n", dropletGUID, appName)
+
+	var rollout deployment
+	if rollout, err = createDeployment(conn, appGUID, dropletGUID); err != nil {
+		return err
+	}
+
+	deadline := now().Add(deploymentTimeout)
+	for !rollout.finished() {
+		if !now().Before(deadline) {
+			return fmt.Errorf("The deployment %s did not finish within %s, it keeps running on the foundation.", rollout.GUID, deploymentTimeout)
+		}
+
+		spinner.Next()
+		if sleep(ctx, pollInterval) != nil {
+			return fmt.Errorf("Stopped waiting for the deployment %s, it keeps running on the foundation.", rollout.GUID)
+		}
+
+		if rollout, err = getDeployment(conn, rollout.GUID); err != nil {
+			return err
+		}
+	}
+	spinner.Done()
+
+	if rollout.outcome() != "DEPLOYED" {
+		return fmt.Errorf("The deployment %s finished as %s.", rollout.GUID, rollout.outcome())
+	}
+
+	printFormatted("Finished rolling out droplet %s to %s.\n", dropletGUID, appName)
+	return nil
+}
+
+// getLatestPackage returns the most recently uploaded package of the app.
+func getLatestPackage(conn plugin.CliConnection, appGUID string) (string, error) {
+	var packages packageList
+
+	query := url.Values{"app_guids": {appGUID}, "order_by": {"-created_at"}, "per_page": {"1"}}
+	packagesJSON, err := curlV3(conn, "GET", "/v3/packages?"+query.Encode(), "")
+	if err != nil {
+		return "", err
+	}
+
+	if err = json.Unmarshal(packagesJSON, &packages); err != nil {
+		return "", err
+	}
+
+	if len(packages.Resources) == 0 {
+		return "", errors.New("The app does not have a package to stage.")
+	}
+
+	if latest := packages.Resources[0]; latest.State != "READY" {
+		return "", fmt.Errorf("The latest package of the app is %s, not READY.", latest.State)
+	}
+
+	return packages.Resources[0].GUID, nil
+}
+
+func createBuild(conn plugin.CliConnection, packageGUID string) (build, error) {
+	body := fmt.Sprintf(`{"package":{"guid":%q}}`, packageGUID)
+	return parseBuild(curlV3(conn, "POST", "/v3/builds", body))
+}
+
+func getBuild(conn plugin.CliConnection, buildGUID string) (build, error) {
+	return parseBuild(curlV3(conn, "GET", fmt.Sprintf("/v3/builds/%s", buildGUID), ""))
+}
+
+func parseBuild(buildJSON []byte, err error) (build, error) {
+	var staged build
+	if err != nil {
+		return staged, err
+	}
+
+	err = json.Unmarshal(buildJSON, &staged)
+	return staged, err
+}
+
+func createDeployment(conn plugin.CliConnection, appGUID string, dropletGUID string) (deployment, error) {
+	body := fmt.Sprintf(`{"droplet":{"guid":%q},"strategy":"rolling","relationships":{"app":{"data":{"guid":%q}}}}`, dropletGUID, appGUID)
+	return parseDeployment(curlV3(conn, "POST", "/v3/deployments", body))
+}
+
+func getDeployment(conn plugin.CliConnection, deploymentGUID string) (deployment, error) {
+	return parseDeployment(curlV3(conn, "GET", fmt.Sprintf("/v3/deployments/%s", deploymentGUID), ""))
+}
+
+func parseDeployment(deploymentJSON []byte, err error) (deployment, error) {
+	var rollout deployment
+	if err != nil {
+		return rollout, err
+	}
+
+	err = json.Unmarshal(deploymentJSON, &rollout)
+	return rollout, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_Success_Restage(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "STAGED", "", "DEPLOYED")
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Contains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/builds", "-d", `{"package":{"guid":"package-guid"}}`})
+	require.Contains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/deployments", "-d", `{"droplet":{"guid":"droplet-guid"},"strategy":"rolling","relationships":{"app":{"data":{"guid":"valid-app-guid"}}}}`})
+	require.Equal(t, []string{
+		"Staging a new droplet for testApp.\n",
+		"Finished staging droplet droplet-guid for testApp.\n",
+		"Rolling out droplet droplet-guid to testApp.\n",
+		"Finished rolling out droplet droplet-guid to testApp.\n",
+	}, output)
+
+	_, err := os.Stat(statePath("valid-app-guid"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRollingRestart_Run_RestageStagingFails(t *testing.T) {
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "FAILED", "StagerError", "DEPLOYED")
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.NotContains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/deployments", "-d", `{"droplet":{"guid":"droplet-guid"},"strategy":"rolling","relationships":{"app":{"data":{"guid":"valid-app-guid"}}}}`})
+	require.Equal(t, "Failed to stage a new droplet for testApp.\n", output[1])
+	require.Equal(t, "Staging failed: StagerError\n", output[2])
+}
+
+func TestRollingRestart_Run_RestageResumeStagesAgainAfterFailedStaging(t *testing.T) {
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "FAILED", "StagerError", "DEPLOYED")
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+	require.Equal(t, exitCode, 1)
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "FAILED", "StagerError", "DEPLOYED")
+	rr.Run(cliConn, []string{"rolling-restage", "--resume", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output, "Staging a new droplet for testApp.\n")
+	require.Contains(t, output, "Failed to stage a new droplet for testApp.\n")
+}
+
+func TestRollingRestart_Run_RestageResumeRollsOutTheStagedDroplet(t *testing.T) {
+	state := newRolloutState("testApp", "valid-app-guid")
+	state.Droplet = "staged-droplet-guid"
+	require.NoError(t, state.save())
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "STAGED", "", "DEPLOYED")
+	rr.Run(cliConn, []string{"rolling-restage", "--resume", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.NotContains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/builds", "-d", `{"package":{"guid":"package-guid"}}`})
+	require.Contains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/deployments", "-d", `{"droplet":{"guid":"staged-droplet-guid"},"strategy":"rolling","relationships":{"app":{"data":{"guid":"valid-app-guid"}}}}`})
+	require.Contains(t, output, "Skipping staging of testApp, droplet staged-droplet-guid was staged by the resumed run.\n")
+}
+
+func TestRollingRestart_Run_RestageDeploymentCanceled(t *testing.T) {
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "STAGED", "", "CANCELED")
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Failed to roll out droplet droplet-guid to testApp.\n", output[3])
+	require.Equal(t, "The deployment deployment-guid finished as CANCELED.\n", output[4])
+
+	state, err := loadRolloutState("valid-app-guid")
+	require.NoError(t, err)
+	require.Equal(t, "droplet-guid", state.Droplet)
+}
+
+func TestRollingRestart_Run_RestagePackageNotReady(t *testing.T) {
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("PROCESSING_UPLOAD", "STAGED", "", "DEPLOYED")
+
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "The latest package of the app is PROCESSING_UPLOAD, not READY.\n", output[1])
+}
+
+func TestRollingRestart_Run_DryRun_Restage(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupRestageCliCommandWithoutTerminalOutputStub("READY", "STAGED", "", "DEPLOYED")
+
+	rr.Run(cliConn, []string{"rolling-restage", "--dry-run", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.NotContains(t, curlCalls(), []string{"curl", "-X", "POST", "/v3/builds", "-d", `{"package":{"guid":"package-guid"}}`})
+	require.Equal(t, []string{"Stage a new droplet for testApp from its latest package and roll it out with a rolling deployment.\n"}, output)
+}
+
+func TestRollingRestart_Run_RestageRejectsRestartFlags(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restage", "--batch-size", "2", "--canary", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "rolling-restage rolls the new droplet out with a deployment and does not take --batch-size, --canary, please try again.\n", output[0])
+}
+
+func TestRollingRestart_Run_RestageRequiresV3(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restage", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Contains(t, output[0], "Restaging requires the V3 API")
+}
+
+// setupRestageCliCommandWithoutTerminalOutputStub answers the V3 packages,
+// builds and deployments endpoints, with the build still staging and the
+// deployment still deploying on the first poll, and leaves the rest to the V3
+// stub.
+func setupRestageCliCommandWithoutTerminalOutputStub(packageState string, buildState string, buildError string, deploymentReason string) {
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+	v3 := cliConn.CliCommandWithoutTerminalOutputStub
+
+	polls, deploymentPolls := 0, 0
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		switch {
+		case reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/packages?app_guids=valid-app-guid&order_by=-created_at&per_page=1"}):
+			return []string{`{"resources": [{"guid": "package-guid", "state": "` + packageState + `"}]}`}, nil
+		case len(args) > 3 && args[2] == "POST" && args[3] == "/v3/builds":
+			return []string{`{"guid": "build-guid", "state": "STAGING"}`}, nil
+		case reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/builds/build-guid"}):
+			if polls++; polls == 1 {
+				return []string{`{"guid": "build-guid", "state": "STAGING"}`}, nil
+			}
+			return []string{`{"guid": "build-guid", "state": "` + buildState + `", "error": "` + buildError + `", "droplet": {"guid": "droplet-guid"}}`}, nil
+		case len(args) > 3 && args[2] == "POST" && args[3] == "/v3/deployments":
+			return []string{`{"guid": "deployment-guid", "state": "DEPLOYING", "status": {"value": "ACTIVE", "reason": "DEPLOYING"}}`}, nil
+		case reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/deployments/deployment-guid"}):
+			if deploymentPolls++; deploymentPolls == 1 {
+				return []string{`{"guid": "deployment-guid", "state": "DEPLOYING", "status": {"value": "ACTIVE", "reason": "DEPLOYING"}}`}, nil
+			}
+			return []string{`{"guid": "deployment-guid", "state": "` + deploymentReason + `", "status": {"value": "FINALIZED", "reason": "` + deploymentReason + `"}}`}, nil
+		}
+		return v3(args...)
+	}
+}
+
+func curlCalls() [][]string {
+	var calls [][]string
+	for i := 0; i < cliConn.CliCommandWithoutTerminalOutputCallCount(); i++ {
+		calls = append(calls, cliConn.CliCommandWithoutTerminalOutputArgsForCall(i))
+	}
+	return calls
+}
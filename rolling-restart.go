@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"regexp"
@@ -27,30 +38,182 @@ var (
 	printLine            = fmt.Println
 	printFormatted       = fmt.Printf
 	spinner              = NewSpinner(os.Stdout)
+	sleep                = sleepContext
+	withInterrupt        = interruptContext
+	detach               = newCommandConnection
+	now                  = time.Now
+	stdin                = io.Reader(os.Stdin)
+	stdout               = io.Writer(os.Stdout)
+	stderr               = io.Writer(os.Stderr)
 	exit                 = os.Exit
 	printRedBold         = color.New(color.FgRed, color.Bold).Println
 	successfulExit       = 0
 	failureExit          = 1
+
+	// events is the log of state transitions written with --events-file.
+	events = &eventLog{}
+
+	// report collects the outcome of the current run for --output json.
+	report = newRunReport()
+
+	// useV3 is set once the API root has been checked and selects the V3
+	// process stats endpoint over the deprecated V2 instances endpoint.
+	useV3 = false
+)
+
+// Options set from the command line flags, see setFlagsAndReturnAppNames.
+var (
+	batchSize         = 1
+	batchPercent      = 0
+	canary            = false
+	canarySoak        = time.Minute
+	processType       = ""
+	allProcesses      = false
+	healthURL         = ""
+	healthStatus      = 0
+	healthBody        *regexp.Regexp
+	stableFor         time.Duration
+	maxFailures       = 0
+	onFailure         = abortOnFailure
+	parallelApps      = 1
+	labelSelector     = ""
+	dryRun            = false
+	resume            = false
+	olderThan         time.Duration
+	selectedInstances []string
+	instanceOrder     = numericOrder
+	spreadBy          = ""
+	minHealthy        = 0
+	surge             = 0
+	restage           = false
+	stagingTimeout    = 15 * time.Minute
+	deploymentTimeout = 30 * time.Minute
+	minHealthyPercent = false
+	onlyUnhealthy     = false
+	watch             = false
+	watchInterval     = 30 * time.Second
+	outputFormat      = textOutput
+	eventsFile        = ""
+	junitFile         = ""
+	waitTimeout       time.Duration
+	pollInterval      = time.Second
+	backoff           = false
+	maxPollInterval   = 30 * time.Second
+	allInSpace        = false
+	allInOrg          = false
+)
+
+// Formats for --output.
+const (
+	textOutput = "text"
+	jsonOutput = "json"
+)
+
+// Orders for --order.
+const (
+	numericOrder     = "numeric"
+	reverseOrder     = "reverse"
+	randomOrder      = "random"
+	oldestFirstOrder = "oldest-first"
+)
+
+// Failure domains for --spread-by.
+const (
+	cellSpread = "cell"
+	zoneSpread = "zone"
+)
+
+// Policies for --on-failure.
+const (
+	abortOnFailure    = "abort"
+	continueOnFailure = "continue"
+	pauseOnFailure    = "pause"
 )
 
 // Instance provides basicinformation for a CF application which includes
-// the current state as well as uptime and last updated time.
+// the current state as well as uptime and last updated time. Since is only
+// reported by the V2 API, Host and Zone only by the V3 API.
 type Instance struct {
+	Index  int    `json:"index"`
 	State  string `json:"state"`
 	Uptime int    `json:"uptime"`
 	Since  int    `json:"since"`
+	Host   string `json:"host"`
+	Zone   string `json:"zone"`
 }
 
 // Instances is grouping of CF Instance for an application.
 type Instances map[string]Instance
 
+// application identifies an app to restart. The GUID and state are only
+// known up front when the app was found through the V3 API.
+type application struct {
+	name    string
+	guid    string
+	stopped bool
+}
+
+// target identifies the process of an application being restarted. The
+// process GUID is only set when instances are managed through the V3 API.
+type target struct {
+	appName     string
+	appGUID     string
+	processType string
+	processGUID string
+	healthURL   string
+	report      *appReport
+	state       *rolloutState
+}
+
+func (t target) String() string {
+	if t.processGUID == "" {
+		return t.appName
+	}
+	return fmt.Sprintf("%s (%s)", t.appName, t.processType)
+}
+
 // RollingRestart provides basic structure required by CF CLI Plugins.
 type RollingRestart struct {
 	Version plugin.VersionType
 }
 
+// restageFlags are the flags rolling-restage takes. The instances are replaced
+// by a deployment rather than restarted one by one by the plugin, so the flags
+// shaping the restarts do not apply.
+var restageFlags = map[string]bool{
+	"staging-timeout":    true,
+	"deployment-timeout": true,
+	"poll-interval":      true,
+	"parallel-apps":      true,
+	"selector":           true,
+	"all-in-space":       true,
+	"all-in-org":         true,
+	"resume":             true,
+	"dry-run":            true,
+	"output":             true,
+	"events-file":        true,
+}
+
 // GetMetadata returns the pertinent metadata for the CF CLI Plugin architecture.
 func (c *RollingRestart) GetMetadata() plugin.PluginMetadata {
+	options := map[string]string{}
+	restageOptions := map[string]string{}
+
+	rrsFlags, _ := newFlagSet("rolling-restart")
+	rrsFlags.VisitAll(func(f *flag.Flag) {
+		usage := strings.TrimSuffix(strings.TrimSuffix(f.Usage, " (Optional)"), ".")
+		switch f.DefValue {
+		case "", "0", "0s", "false":
+		default:
+			usage += ", defaults to " + f.DefValue
+		}
+
+		options["-"+f.Name] = usage
+		if restageFlags[f.Name] {
+			restageOptions["-"+f.Name] = usage
+		}
+	})
+
 	return plugin.PluginMetadata{
 		Name:    "cf-rolling-restart",
 		Version: c.Version,
@@ -65,7 +228,16 @@ func (c *RollingRestart) GetMetadata() plugin.PluginMetadata {
 				HelpText: "Restart instances of your application one at a time for zero downtime.",
 				Alias:    "rrs",
 				UsageDetails: plugin.Usage{
-					Usage: "cf rolling-restart [--max-cycles #] APP_NAME",
+					Usage:   "cf rolling-restart [OPTIONS] APP_NAME [APP_NAME...]",
+					Options: options,
+				},
+			},
+			{
+				Name:     "rolling-restage",
+				HelpText: "Stage a new droplet for your application and roll it out with a rolling deployment.",
+				UsageDetails: plugin.Usage{
+					Usage:   "cf rolling-restage [OPTIONS] APP_NAME [APP_NAME...]",
+					Options: restageOptions,
 				},
 			},
 		},
@@ -74,7 +246,7 @@ func (c *RollingRestart) GetMetadata() plugin.PluginMetadata {
 
 // Run executes the main code for Rolling Restart, exposes all required actions for a plugin.
 func (c *RollingRestart) Run(conn plugin.CliConnection, args []string) {
-	if args[0] != "rolling-restart" && args[0] != "rrs" {
+	if args[0] != "rolling-restart" && args[0] != "rrs" && args[0] != "rolling-restage" {
 		return
 	}
 
@@ -85,111 +257,955 @@ func (c *RollingRestart) Run(conn plugin.CliConnection, args []string) {
 }
 
 func execute(conn plugin.CliConnection, args []string) (exitCode int) {
-	var appName string
-	var appGUID string
-	var instances Instances
-	var instanceIDs []string
-	var restarted bool
+	var appNames []string
 	var err error
 
-	if appName, err = setFlagsAndReturnAppName(args); err != nil {
+	if appNames, err = setFlagsAndReturnAppNames(args); err != nil {
 		printError(err.Error())
 		return failureExit
 	}
 
+	report = newRunReport()
+	if junitFile != "" {
+		defer func() {
+			if err := writeJUnitReport(junitFile, report); err != nil {
+				printFormatted("Failed to write the JUnit report to %s.\n", junitFile)
+				printError(err.Error())
+				exitCode = failureExit
+			}
+		}()
+	}
+
+	if outputFormat == jsonOutput {
+		defer useJSONOutput()()
+		defer func() {
+			if err := report.write(stdout, exitCode); err != nil {
+				exitCode = failureExit
+			}
+		}()
+	}
+
+	if eventsFile != "" {
+		var closeEvents func() error
+		if closeEvents, err = openEventsFile(eventsFile); err != nil {
+			printFormatted("Failed to open the events file %s.\n", eventsFile)
+			printError(err.Error())
+			return failureExit
+		}
+		defer closeEvents()
+	}
+
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
 	if err = validateCLISession(conn); err != nil {
 		printError(err.Error())
 		return failureExit
 	}
+	events.emit(event{Event: eventSessionValidated})
 
-	if appGUID, err = getappGUID(conn, appName); err != nil {
+	if useV3, err = supportsV3(conn); err != nil {
+		printFormatted("Failed to determine the API versions supported by the foundation.\n")
 		printError(err.Error())
 		return failureExit
 	}
 
-	if instances, err = getInstances(conn, appGUID); err != nil {
-		printFormatted("Failed to get the instance information for %s.\n", appName)
-		printError(err.Error())
+	if restage && !useV3 {
+		printError("Restaging requires the V3 API, which this foundation does not advertise.")
 		return failureExit
 	}
 
-	if instanceIDs = getKeysFor(instances); len(instanceIDs) < 2 {
-		printFormatted("Only found a single instance of %s, scaling up to two instances.\n", appName)
+	if spreadBy != "" && !useV3 {
+		printError("Spreading the restart across cells or zones requires the V3 API, which this foundation does not advertise.")
+		return failureExit
+	}
 
-		if err = scaleApplication(conn, appName, 2); err != nil {
-			printFormatted("Failed to scale %s to two instances.\n", appName)
+	apps := make([]application, len(appNames))
+	for i, appName := range appNames {
+		apps[i] = application{name: appName}
+	}
+
+	searching := labelSelector != "" || allInSpace || allInOrg
+
+	var skipped []application
+	if searching {
+		var found []application
+		if found, err = findApps(conn); err != nil {
+			printFormatted("Failed to find the apps %s.\n", describeSearch())
 			printError(err.Error())
 			return failureExit
 		}
 
-		if _, err = checkInstanceStatus(conn, appGUID, "1"); err != nil {
-			printFormatted("Failed to get the instance information for %s.\n", appName)
+		apps = nil
+		for _, app := range found {
+			if app.stopped {
+				printFormatted("Skipping %s, the app is stopped.\n", app.name)
+				skipped = append(skipped, app)
+				continue
+			}
+			apps = append(apps, app)
+		}
+
+		if len(apps) == 0 {
+			printFormatted("No started apps were found %s.\n", describeSearch())
+			return successfulExit
+		}
+
+		printFormatted("Found %d app(s) %s.\n", len(apps), describeSearch())
+	}
+
+	if watch {
+		return watchApps(ctx, conn, apps)
+	}
+
+	if len(apps) == 1 && !searching {
+		return restartApp(ctx, conn, apps[0])
+	}
+
+	results := restartApps(ctx, conn, apps)
+	printResults(apps, results, skipped)
+
+	for _, result := range results {
+		if result != successfulExit {
+			return failureExit
+		}
+	}
+
+	return successfulExit
+}
+
+// useJSONOutput moves the human readable output to stderr and silences the
+// spinner so that stdout only holds the JSON report. It returns a function
+// that restores the regular output.
+func useJSONOutput() func() {
+	oldPrintLine, oldPrintFormatted, oldPrintRedBold, oldSpinner := printLine, printFormatted, printRedBold, spinner
+
+	printLine = func(a ...interface{}) (int, error) { return fmt.Fprintln(stderr, a...) }
+	printFormatted = func(format string, a ...interface{}) (int, error) { return fmt.Fprintf(stderr, format, a...) }
+	printRedBold = func(a ...interface{}) (int, error) { return color.New(color.FgRed, color.Bold).Fprintln(stderr, a...) }
+	spinner = NewSpinner(ioutil.Discard)
+
+	return func() {
+		printLine, printFormatted, printRedBold, spinner = oldPrintLine, oldPrintFormatted, oldPrintRedBold, oldSpinner
+	}
+}
+
+// describeSearch describes which apps are restarted by --selector,
+// --all-in-space and --all-in-org for use in messages.
+func describeSearch() string {
+	scope := "in the targeted space"
+	if allInOrg {
+		scope = "in the targeted org"
+	}
+
+	if labelSelector != "" {
+		return fmt.Sprintf("matching %s %s", labelSelector, scope)
+	}
+	return scope
+}
+
+// restartApps restarts each of the apps, running up to --parallel-apps of them
+// at the same time, and returns the exit code of each app in the same order.
+// Apps that were not started before an interrupt are counted as failed.
+func restartApps(ctx context.Context, conn plugin.CliConnection, apps []application) []int {
+	results := make([]int, len(apps))
+	slots := make(chan struct{}, parallelApps)
+
+	var wg sync.WaitGroup
+	for i, app := range apps {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			printFormatted("Skipping %s, the restart was interrupted.\n", app.name)
+			results[i] = failureExit
+			<-slots
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(i int, app application) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i] = restartApp(ctx, conn, app)
+		}(i, app)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// watchApps restarts the unhealthy instances of the apps every
+// --watch-interval until the plugin is interrupted, failing when any of the
+// apps could not be healed along the way.
+func watchApps(ctx context.Context, conn plugin.CliConnection, apps []application) int {
+	printFormatted("Watching %d app(s) for unhealthy instances every %s, press Ctrl-C to stop.\n", len(apps), watchInterval)
+
+	failedHeals := 0
+	for {
+		// Each cycle is reported on its own, so the report only holds the
+		// last cycle rather than growing for as long as the watch runs.
+		report = newRunReport()
+
+		for i, result := range restartApps(ctx, conn, apps) {
+			if result != successfulExit && ctx.Err() == nil {
+				failedHeals++
+				printFormatted("Failed to heal %s, checking it again in %s.\n", apps[i].name, watchInterval)
+			}
+		}
+
+		if sleep(ctx, watchInterval) != nil {
+			printFormatted("Stopped watching for unhealthy instances.\n")
+			if failedHeals > 0 {
+				printFormatted("%d heal(s) failed while watching.\n", failedHeals)
+				return failureExit
+			}
+			return successfulExit
+		}
+	}
+}
+
+// printResults outputs a table with the outcome of the restart of each app,
+// followed by the totals when more than a handful of apps were involved.
+func printResults(apps []application, results []int, skipped []application) {
+	var table bytes.Buffer
+	var failed int
+
+	writer := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "APP\tRESULT")
+	for i, app := range apps {
+		result := "succeeded"
+		if results[i] != successfulExit {
+			result = "failed"
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\n", app.name, result)
+	}
+	for _, app := range skipped {
+		fmt.Fprintf(writer, "%s\t%s\n", app.name, "skipped (stopped)")
+	}
+	writer.Flush()
+
+	printFormatted("Rolling restart results:\n%s", table.String())
+	printFormatted("%d succeeded, %d failed, %d skipped.\n", len(apps)-failed, failed, len(skipped))
+}
+
+// restartApp restarts every selected process of a single application, or
+// restages it for rolling-restage. The app GUID is looked up by name unless
+// it is already known.
+func restartApp(ctx context.Context, conn plugin.CliConnection, app application) (exitCode int) {
+	var targets []target
+	var err error
+
+	appName := app.name
+	appGUID := app.guid
+	if appGUID == "" {
+		if appGUID, err = getappGUID(conn, appName); err != nil {
 			printError(err.Error())
+			report.addFailedApp(appName, "", err)
 			return failureExit
 		}
+	}
+	events.emit(event{Event: eventGUIDResolved, App: appName, GUID: appGUID})
 
-		printFormatted("Finished scaling %s to two instances.\n", appName)
+	if restage {
+		return restageApp(ctx, conn, appName, appGUID)
 	}
 
-	printFormatted("Beginning restart of app instances for %s.\n", appName)
+	if targets, err = getTargets(conn, appName, appGUID); err != nil {
+		printFormatted("Failed to get the processes for %s.\n", appName)
+		printError(err.Error())
+		report.addFailedApp(appName, appGUID, err)
+		return failureExit
+	}
 
-	for _, instanceID := range instanceIDs {
-		if err = restartInstance(conn, appName, instanceID); err != nil {
-			printFormatted("Failed to restart instance %s.\n", instanceID)
+	if healthURL != "" {
+		var url string
+		if url, err = resolveHealthURL(conn, appName, appGUID); err != nil {
+			printFormatted("Failed to determine the health check URL for %s.\n", appName)
 			printError(err.Error())
+			report.addFailedApp(appName, appGUID, err)
 			return failureExit
 		}
 
-		if restarted, err = checkInstanceStatus(conn, appGUID, instanceID); err != nil {
-			printFormatted("Failed to get the instance information for %s.\n", appName)
+		for i := range targets {
+			if targets[i].processType == "web" {
+				targets[i].healthURL = url
+			}
+		}
+	}
+
+	var state *rolloutState
+	if state, err = startRollout(appName, appGUID); err != nil {
+		printFormatted("Failed to load the saved progress of %s.\n", appName)
+		printError(err.Error())
+		report.addFailedApp(appName, appGUID, err)
+		return failureExit
+	}
+
+	for _, t := range targets {
+		t.report = report.addApp(appName, appGUID, t.processType)
+		t.state = state
+		if exitCode = restartProcess(ctx, conn, t); exitCode != successfulExit {
+			return exitCode
+		}
+	}
+
+	if !dryRun {
+		if err = state.remove(); err != nil {
+			printFormatted("Failed to remove the saved progress of %s: %s\n", appName, err)
+		}
+	}
+
+	return successfulExit
+}
+
+// restartProcess rolls through every instance of a single application process.
+// Once the context is cancelled no further instances are restarted, the wait
+// for the ones in flight is cut short and the instance count is restored.
+func restartProcess(ctx context.Context, conn plugin.CliConnection, t target) (exitCode int) {
+	var instances Instances
+	var restarted []string
+	var err error
+
+	defer func() { t.report.finish(exitCode) }()
+
+	restore := func() error { return nil }
+	defer func() {
+		if restore() != nil {
+			exitCode = failureExit
+		}
+	}()
+
+	if instances, err = getInstances(conn, t); err != nil {
+		printFormatted("Failed to get the instance information for %s.\n", t)
+		printError(err.Error())
+		return failureExit
+	}
+
+	if spreadBy == zoneSpread {
+		for _, instanceID := range getKeysFor(instances) {
+			if instances[instanceID].Zone == "" {
+				printFormatted("Failed to spread the restart of %s across availability zones.\n", t)
+				printError(fmt.Sprintf("The foundation does not report the availability zone of instance %s.", instanceID))
+				return failureExit
+			}
+		}
+	}
+
+	plan := planRestart(t, instances)
+	if required, available := plan.minHealthy(); required > available {
+		printFormatted("Failed to plan the restart of %s.\n", t)
+		printError(fmt.Sprintf("--min-healthy requires %d of the other instances to be running, but at most %d can be while instances are restarting.", required, available))
+		return failureExit
+	}
+
+	if dryRun {
+		printPlan(t, plan)
+		return successfulExit
+	}
+
+	if ctx.Err() != nil {
+		printFormatted("Skipping %s, the restart was interrupted.\n", t)
+		return failureExit
+	}
+
+	for _, skip := range plan.skipped {
+		printFormatted("Skipping instance %s of %s, %s.\n", skip.instanceID, t, skip.reason)
+	}
+
+	if len(plan.instanceIDs()) == 0 {
+		printFormatted("No instances of %s need to be restarted.\n", t)
+		return successfulExit
+	}
+
+	interrupted := func() int {
+		restore()
+		printInterrupted(t, plan, restarted)
+		return failureExit
+	}
+
+	if plan.surge > 0 {
+		scaled := describeCount(plan.originalCount + plan.surge)
+		if surge == 0 {
+			printFormatted("Only found a single instance of %s, scaling up to two instances.\n", t)
+		} else {
+			printFormatted("Scaling %s up to %s before restarting the original instances.\n", t, scaled)
+		}
+
+		restore = restoreInstanceCount(ctx, conn, t, plan.originalCount)
+
+		requested := now()
+		if err = scaleApplication(conn, t, plan.originalCount+plan.surge); err != nil {
+			printFormatted("Failed to scale %s to %s.\n", t, scaled)
 			printError(err.Error())
 			return failureExit
 		}
 
-		if restarted == false {
-			printError(fmt.Sprintf("Application did not restart within %d Second(s), failing out. Check your current application state.\n", maxRestartWaitCycles))
+		var notStarted []string
+		if notStarted, err = checkInstanceStatus(ctx, conn, t, requested, plan.surgeIDs()...); err != nil {
+			if ctx.Err() != nil {
+				return interrupted()
+			}
+			printFormatted("Failed to get the instance information for %s.\n", t)
+			printError(err.Error())
 			return failureExit
 		}
+
+		// A single instance app has always been restarted even when its
+		// second instance was slow to start, an explicit --surge has to be
+		// up before the capacity it adds is relied on.
+		if surge > 0 && len(notStarted) > 0 {
+			printFormatted("The added %s of %s did not start within %s, no instances were restarted.\n", describeInstances(notStarted), t, describeWaitLimit())
+			return failureExit
+		}
+
+		printFormatted("Finished scaling %s to %s.\n", t, scaled)
 	}
 
-	if len(instanceIDs) == 1 {
-		printFormatted("Scaling %s back down to one instance.\n", appName)
-		scaleApplication(conn, appName, 1)
+	printFormatted("Beginning restart of app instances for %s.\n", t)
+
+	if plan.canaryID != "" {
+		printFormatted("Restarting instance %s of %s as a canary.\n", plan.canaryID, t)
+
+		canaryRestarted, failures := restartBatch(ctx, conn, t, []string{plan.canaryID})
+		if restarted = canaryRestarted; ctx.Err() != nil {
+			return interrupted()
+		}
+
+		if len(failures) > 0 {
+			return failureExit
+		}
+
+		if err = soakCanary(ctx, conn, t, plan.canaryID); err != nil {
+			if ctx.Err() != nil {
+				return interrupted()
+			}
+			printFormatted("Canary instance %s did not stay healthy, no other instances of %s were restarted.\n", plan.canaryID, t)
+			printError(err.Error())
+			t.report.instance(plan.canaryID).fail(err.Error())
+			return failureExit
+		}
 	}
 
-	printFormatted("Finished restart of app instances for %s.\n", appName)
+	if plan.batchSize > 1 {
+		printFormatted("Restarting %d instances of %s at a time.\n", plan.batchSize, t)
+	}
+
+	var failures []instanceFailure
+	for _, batch := range plan.batches {
+		if ctx.Err() != nil {
+			break
+		}
+
+		batchRestarted, batchFailures := restartBatch(ctx, conn, t, batch)
+		restarted = append(restarted, batchRestarted...)
+		if len(batchFailures) == 0 {
+			continue
+		}
+
+		if failures = append(failures, batchFailures...); !continueAfterFailure(t, len(failures)) {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		exitCode = interrupted()
+		if len(failures) > 0 {
+			printFailures(t, failures)
+		}
+		return exitCode
+	}
+
+	if restore() != nil {
+		return failureExit
+	}
+
+	if len(failures) > 0 {
+		printFailures(t, failures)
+		return failureExit
+	}
+
+	printFormatted("Finished restart of app instances for %s.\n", t)
 
 	return successfulExit
 }
 
-func scaleApplication(conn plugin.CliConnection, appName string, numberOfInstances int) error {
-	_, err := conn.CliCommand("scale", appName, "-i", strconv.Itoa(numberOfInstances))
+// instanceFailure records why an instance failed to restart.
+type instanceFailure struct {
+	instanceID string
+	reason     string
+}
+
+// restartBatch restarts each of the given instances and waits for them to come
+// back, returning the instances it restarted and reporting and returning the
+// ones that failed to restart. No more instances are restarted once the
+// context is cancelled.
+func restartBatch(ctx context.Context, conn plugin.CliConnection, t target, batch []string) (restartedIDs []string, failures []instanceFailure) {
+	var notRestarted []string
+	var requested time.Time
+	var err error
+
+	defer func() {
+		t.report.finishBatch(batch, failures)
+		if err := t.state.record(t.processType, restartedIDs, failures); err != nil {
+			printFormatted("Failed to save the progress of %s: %s\n", t, err)
+		}
+	}()
+
+	for _, instanceID := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err = waitForMinHealthy(ctx, conn, t, instanceID, restartedIDs); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			printFormatted("Not restarting instance %s of %s.\n", instanceID, t)
+			printError(err.Error())
+			failures = append(failures, instanceFailure{instanceID, err.Error()})
+			break
+		}
+
+		if requested.IsZero() {
+			requested = now()
+		}
+
+		t.report.startInstance(instanceID)
+		if err = restartInstance(conn, t, instanceID); err != nil {
+			printFormatted("Failed to restart instance %s.\n", instanceID)
+			printError(err.Error())
+			failures = append(failures, instanceFailure{instanceID, err.Error()})
+
+			if onFailure == abortOnFailure {
+				break
+			}
+			continue
+		}
+		restartedIDs = append(restartedIDs, instanceID)
+	}
+
+	if len(restartedIDs) == 0 {
+		return restartedIDs, failures
+	}
+
+	if notRestarted, err = checkInstanceStatus(ctx, conn, t, requested, restartedIDs...); err != nil {
+		reason := err.Error()
+		if ctx.Err() != nil {
+			printFormatted("Stopped waiting for %s of %s.\n", describeInstances(restartedIDs), t)
+			reason = "The restart was interrupted before the instance was running again."
+		} else {
+			printFormatted("Failed to get the instance information for %s.\n", t)
+			printError(err.Error())
+		}
+
+		for _, instanceID := range restartedIDs {
+			failures = append(failures, instanceFailure{instanceID, reason})
+		}
+		return restartedIDs, failures
+	}
+
+	if len(notRestarted) > 0 {
+		printError(fmt.Sprintf("Application did not restart within %s, failing out. Check your current application state.\n", describeWaitLimit()))
+		for _, instanceID := range notRestarted {
+			failures = append(failures, instanceFailure{instanceID, fmt.Sprintf("Did not restart within %s.", describeWaitLimit())})
+		}
+	}
+
+	return restartedIDs, failures
+}
+
+// continueAfterFailure applies the --on-failure and --max-failures policy once
+// an instance has failed, returning whether the rollout should go on.
+func continueAfterFailure(t target, failureCount int) bool {
+	if onFailure == abortOnFailure {
+		return false
+	}
+
+	if failureCount > maxFailures {
+		printFormatted("Stopping the restart of %s after %d failed instance(s).\n", t, failureCount)
+		return false
+	}
+
+	if onFailure == pauseOnFailure {
+		return confirm("Continue restarting the remaining instances of %s? [y/N]: ", t)
+	}
+
+	return true
+}
+
+// prompts serialises the questions asked on stdin, so that apps restarted in
+// parallel ask one at a time and every answer is read by the app that asked.
+var prompts struct {
+	mutex  sync.Mutex
+	source io.Reader
+	reader *bufio.Reader
+}
+
+// confirm asks the question and returns whether it was answered with yes.
+func confirm(format string, a ...interface{}) bool {
+	prompts.mutex.Lock()
+	defer prompts.mutex.Unlock()
+
+	if prompts.source != stdin {
+		prompts.source, prompts.reader = stdin, bufio.NewReader(stdin)
+	}
+
+	printFormatted(format, a...)
+
+	line, err := prompts.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// printFailures lists every instance that failed to restart.
+func printFailures(t target, failures []instanceFailure) {
+	printFormatted("The following instances of %s failed to restart:\n", t)
+	for _, failure := range failures {
+		printFormatted("  instance %s: %s\n", failure.instanceID, failure.reason)
+	}
+}
+
+// soakCanary watches a freshly restarted instance for the soak period and
+// returns an error if it stops running or restarts itself along the way.
+func soakCanary(ctx context.Context, conn plugin.CliConnection, t target, instanceID string) error {
+	printFormatted("Watching canary instance %s for %s.\n", instanceID, canarySoak)
+
+	var instances Instances
+	var previous Instance
+	var err error
+
+	cycles := int(canarySoak / pollInterval)
+	for i := 0; i <= cycles; i++ {
+		spinner.Next()
+
+		if instances, err = getInstances(conn, t); err != nil {
+			return err
+		}
+
+		instance, found := instances[instanceID]
+		if !found {
+			return fmt.Errorf("Canary instance %s is no longer reported for the application.", instanceID)
+		}
+
+		if instance.State != "RUNNING" {
+			return fmt.Errorf("Canary instance %s went to %s during the soak period.", instanceID, instance.State)
+		}
+
+		if i > 0 && (instance.Since != previous.Since || instance.Uptime < previous.Uptime) {
+			return fmt.Errorf("Canary instance %s restarted during the soak period.", instanceID)
+		}
+
+		previous = instance
+		if i < cycles {
+			if err = sleep(ctx, pollInterval); err != nil {
+				return err
+			}
+		}
+	}
+
+	spinner.Done()
+	return nil
+}
+
+// restoreInstanceCount returns a function that scales the process back to its
+// original instance count. It only scales once no matter how often it is
+// called, so it can be used both on the normal path and during cleanup. Once
+// the rollout is interrupted the cf CLI that started the plugin has exited
+// along with its RPC server, so the scale goes through a new cf process.
+func restoreInstanceCount(ctx context.Context, conn plugin.CliConnection, t target, originalCount int) func() error {
+	var once sync.Once
+	var err error
+
+	description := describeCount(originalCount)
+
+	return func() error {
+		once.Do(func() {
+			if ctx.Err() != nil {
+				conn = detach(conn)
+			}
+
+			printFormatted("Scaling %s back down to %s.\n", t, description)
+			if err = scaleApplication(conn, t, originalCount); err != nil {
+				printFormatted("Failed to scale %s back down to %s.\n", t, description)
+				printError(err.Error())
+			}
+		})
+		return err
+	}
+}
+
+// interruptContext returns a context that is cancelled when the plugin
+// receives SIGINT or SIGTERM. Once it is cancelled the signals are no longer
+// caught, so a second interrupt stops the plugin right away.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+// commandConnection runs the cf commands of the plugin in a new cf process
+// instead of over the RPC server of the cf CLI that started the plugin.
+type commandConnection struct {
+	plugin.CliConnection
+}
+
+func newCommandConnection(conn plugin.CliConnection) plugin.CliConnection {
+	return commandConnection{conn}
+}
+
+func (c commandConnection) CliCommand(args ...string) ([]string, error) {
+	return c.CliCommandWithoutTerminalOutput(args...)
+}
+
+func (commandConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	var output, errorOutput bytes.Buffer
+
+	cmd := exec.Command("cf", args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &errorOutput
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(errorOutput.String() + output.String())
+		if message == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%v: %s", err, message)
+	}
+
+	return strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n"), nil
+}
+
+// sleepContext pauses for the duration, returning the context's error early
+// when it is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func scaleApplication(conn plugin.CliConnection, t target, numberOfInstances int) (err error) {
+	started := t.event(eventScaleStarted, "")
+	started.Instances = &numberOfInstances
+	events.emit(started)
+
+	defer func() {
+		finished := t.event(eventScaleFinished, "")
+		finished.Instances = &numberOfInstances
+		finished.Error = errorMessage(err)
+		events.emit(finished)
+	}()
+
+	if t.processGUID != "" {
+		return scaleProcess(conn, t.processGUID, numberOfInstances)
+	}
+
+	_, err = conn.CliCommand("scale", t.appName, "-i", strconv.Itoa(numberOfInstances))
 	return err
 }
 
-func checkInstanceStatus(conn plugin.CliConnection, appGUID string, instanceID string) (bool, error) {
-	printFormatted("Checking status of instance %s.\n", instanceID)
+// getBatchSize returns how many instances should be restarted at once. The
+// batch is always kept smaller than the instance count so that at least one
+// instance of the application stays up.
+func getBatchSize(instanceCount int) int {
+	size := batchSize
+	if batchPercent > 0 {
+		size = int(math.Ceil(float64(instanceCount) * float64(batchPercent) / 100))
+	}
+
+	if size >= instanceCount {
+		size = instanceCount - 1
+	}
+
+	if size < 1 {
+		size = 1
+	}
 
-	var isRunning bool
-	var restarted bool
+	return size
+}
+
+func splitIntoBatches(instanceIDs []string, size int) [][]string {
+	var batches [][]string
+	for start := 0; start < len(instanceIDs); start += size {
+		end := start + size
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+		batches = append(batches, instanceIDs[start:end])
+	}
+	return batches
+}
+
+// stabilityWatch tracks an instance that is running while it has to stay
+// up for the --stable-for window.
+type stabilityWatch struct {
+	since time.Time
+	last  Instance
+}
+
+// checkInstanceStatus waits until every one of the given instances is running
+// again, passes the health check when one is configured and has stayed up for
+// the stability window, returning the instances that did not come back within
+// the timeout. The instances count as running again once they were started
+// after the restart was requested. The stability window is added to the
+// timeout. Waiting stops with the context's error when it is cancelled.
+func checkInstanceStatus(ctx context.Context, conn plugin.CliConnection, t target, requested time.Time, instanceIDs ...string) ([]string, error) {
+	printFormatted("Checking status of %s.\n", describeInstances(instanceIDs))
+
+	var instances Instances
 	var err error
 
-	for i := 0; i < maxRestartWaitCycles; i++ {
+	started := map[string]bool{}
+	watching := map[string]*stabilityWatch{}
+	pending := instanceIDs
+	schedule := newPollSchedule(stableFor)
+	for schedule.next() {
 		spinner.Next()
+		for _, instanceID := range pending {
+			t.report.instance(instanceID).countCycle()
+		}
 
-		if isRunning, err = isInstanceRunning(conn, appGUID, instanceID); err != nil {
-			return false, err
+		if instances, err = getInstances(conn, t); err != nil {
+			return nil, err
 		}
 
-		if isRunning {
+		var stillPending []string
+		for _, instanceID := range pending {
+			instance := instances[instanceID]
+			running := isInstanceRunning(instance, requested)
+
+			polled := t.event(eventInstancePolled, instanceID)
+			polled.State, polled.Uptime, polled.Running = instance.State, &instance.Uptime, &running
+			events.emit(polled)
+
+			if !started[instanceID] && !running {
+				stillPending = append(stillPending, instanceID)
+				continue
+			}
+			started[instanceID] = true
+
+			if t.healthURL != "" && checkInstanceHealth(t.healthURL, t.appGUID, instanceID) != nil {
+				delete(watching, instanceID)
+				stillPending = append(stillPending, instanceID)
+				continue
+			}
+
+			if stableFor == 0 {
+				continue
+			}
+
+			watch, found := watching[instanceID]
+			if found && (instance.State != "RUNNING" || instance.Uptime < watch.last.Uptime || instance.Since != watch.last.Since) {
+				printFormatted("Instance %s restarted before it was stable for %s.\n", instanceID, stableFor)
+				delete(watching, instanceID)
+				started[instanceID] = false
+				stillPending = append(stillPending, instanceID)
+				continue
+			}
+
+			if !found {
+				watch = &stabilityWatch{since: now()}
+				watching[instanceID] = watch
+			}
+			watch.last = instance
+
+			if now().Sub(watch.since) < stableFor {
+				stillPending = append(stillPending, instanceID)
+			}
+		}
+
+		for _, instanceID := range pending {
+			if !containsString(stillPending, instanceID) {
+				events.emit(t.event(eventInstanceHealthy, instanceID))
+			}
+		}
+
+		if pending = stillPending; len(pending) == 0 {
 			spinner.Done()
-			restarted = true
-			break
+			return nil, nil
 		}
 
-		time.Sleep(time.Second)
+		if err = schedule.wait(ctx); err != nil {
+			return pending, err
+		}
 	}
-	return restarted, nil
+
+	for _, instanceID := range pending {
+		events.emit(t.event(eventInstanceTimedOut, instanceID))
+	}
+	return pending, nil
+}
+
+// waitForMinHealthy waits until enough of the other instances of the target
+// are running for --min-healthy before the instance is restarted, giving up
+// once the timeout has passed. The instances restarted earlier in the batch
+// are not counted, they may still be reported as running until they stop.
+func waitForMinHealthy(ctx context.Context, conn plugin.CliConnection, t target, instanceID string, restartedIDs []string) error {
+	if minHealthy == 0 {
+		return nil
+	}
+
+	var running, required int
+	schedule := newPollSchedule(0)
+	for schedule.next() {
+		instances, err := getInstances(conn, t)
+		if err != nil {
+			return err
+		}
+
+		running, required = 0, getMinHealthy(len(instances)-1)
+		for otherID, instance := range instances {
+			if otherID != instanceID && !containsString(restartedIDs, otherID) && instance.State == "RUNNING" {
+				running++
+			}
+		}
+
+		if running >= required {
+			return nil
+		}
+
+		if schedule.polls == 1 {
+			printFormatted("Waiting for %d of the other instances of %s to be running before restarting instance %s, %d are.\n", required, t, instanceID, running)
+		}
+
+		if err = schedule.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Only %d of the other instances of %s were running within %s, at least %d must be.", running, t, describeWaitLimit(), required)
+}
+
+// getMinHealthy returns how many of the other instances must be running
+// before an instance is restarted.
+func getMinHealthy(otherCount int) int {
+	if minHealthyPercent {
+		return int(math.Ceil(float64(otherCount) * float64(minHealthy) / 100))
+	}
+	return minHealthy
 }
 
 func printError(message string) {
@@ -197,27 +1213,298 @@ func printError(message string) {
 	printLine(message)
 }
 
-func setFlagsAndReturnAppName(args []string) (string, error) {
-	rrsFlags := flag.NewFlagSet("rolling-restart", flag.ExitOnError)
-	maxCycles := rrsFlags.Int("max-cycles", maxRestartWaitCycles, "Maximum number of cycles to wait when checking for restart status. (Optional)")
+// commandFlags holds the values of the command line flags.
+type commandFlags struct {
+	staging       *time.Duration
+	deploying     *time.Duration
+	maxCycles     *int
+	timeout       *time.Duration
+	interval      *time.Duration
+	backoffFlag   *bool
+	maxInterval   *time.Duration
+	size          *int
+	percent       *int
+	canaryFlag    *bool
+	process       *string
+	everyProcess  *bool
+	health        *string
+	status        *int
+	body          *string
+	stable        *time.Duration
+	failureLimit  *int
+	failurePolicy *string
+	selector      *string
+	space         *bool
+	org           *bool
+	format        *string
+	eventsPath    *string
+	junitPath     *string
+	only          *string
+	order         *string
+	surgeCount    *int
+	healthy       *string
+	spread        *string
+	unhealthy     *bool
+	watchFlag     *bool
+	watchEvery    *time.Duration
+	age           *time.Duration
+	resumeFlag    *bool
+	dry           *bool
+	parallel      *int
+	soak          *time.Duration
+}
+
+// newFlagSet defines the command line flags of the plugin. The help of the
+// plugin metadata is read from the same definitions.
+func newFlagSet(name string) (*flag.FlagSet, *commandFlags) {
+	rrsFlags := flag.NewFlagSet(name, flag.ExitOnError)
+	return rrsFlags, &commandFlags{
+		staging:       rrsFlags.Duration("staging-timeout", 15*time.Minute, "How long to wait for the new droplet to stage with rolling-restage. (Optional)"),
+		deploying:     rrsFlags.Duration("deployment-timeout", 30*time.Minute, "How long to wait for the deployment of the new droplet with rolling-restage. (Optional)"),
+		maxCycles:     rrsFlags.Int("max-cycles", maxRestartWaitCycles, "Maximum number of cycles to wait when checking for restart status. (Optional)"),
+		timeout:       rrsFlags.Duration("timeout", 0, "How long to wait for an instance to restart, e.g. 5m, instead of counting cycles. (Optional)"),
+		interval:      rrsFlags.Duration("poll-interval", time.Second, "How long to wait between checks of the instance status. (Optional)"),
+		backoffFlag:   rrsFlags.Bool("backoff", false, "Double the poll interval after every check, with jitter, up to --max-poll-interval. (Optional)"),
+		maxInterval:   rrsFlags.Duration("max-poll-interval", 30*time.Second, "Longest poll interval to back off to. (Optional)"),
+		size:          rrsFlags.Int("batch-size", 1, "Number of instances to restart at the same time. (Optional)"),
+		percent:       rrsFlags.Int("batch-percent", 0, "Percentage of instances to restart at the same time. (Optional)"),
+		canaryFlag:    rrsFlags.Bool("canary", false, "Restart a single instance first and watch it before restarting the rest. (Optional)"),
+		process:       rrsFlags.String("process", "", "Process type to restart through the V3 API, e.g. worker. (Optional)"),
+		everyProcess:  rrsFlags.Bool("all-processes", false, "Restart the instances of every process type of the app through the V3 API. (Optional)"),
+		health:        rrsFlags.String("health-url", "", "Path on the app's route, or a full URL, that must return a successful response from each restarted instance. (Optional)"),
+		status:        rrsFlags.Int("health-status", 0, "Status code the health check must return, defaults to any 2xx status. (Optional)"),
+		body:          rrsFlags.String("health-body", "", "Regular expression the health check response body must match. (Optional)"),
+		stable:        rrsFlags.Duration("stable-for", 0, "How long a restarted instance must stay running before moving on, e.g. 30s. (Optional)"),
+		failureLimit:  rrsFlags.Int("max-failures", 0, "Number of failed instances to tolerate with --on-failure continue or pause, defaults to no limit. (Optional)"),
+		failurePolicy: rrsFlags.String("on-failure", abortOnFailure, "What to do when an instance fails to restart: abort, continue or pause. (Optional)"),
+		selector:      rrsFlags.String("selector", "", "Restart every app in the targeted space matching the label selector, e.g. team=payments,env!=dev. (Optional)"),
+		space:         rrsFlags.Bool("all-in-space", false, "Restart every started app in the targeted space. (Optional)"),
+		org:           rrsFlags.Bool("all-in-org", false, "Restart every started app in the targeted org through the V3 API. (Optional)"),
+		format:        rrsFlags.String("output", textOutput, "Output format, text or json. (Optional)"),
+		eventsPath:    rrsFlags.String("events-file", "", "File to append one JSON event per line to for every state change, or - for stderr. (Optional)"),
+		junitPath:     rrsFlags.String("junit", "", "File to write a JUnit XML report of the instance restarts to. (Optional)"),
+		only:          rrsFlags.String("instances", "", "Only restart these instances, e.g. 0,3,5-9. (Optional)"),
+		order:         rrsFlags.String("order", numericOrder, "Order to restart the instances in: numeric, reverse, random or oldest-first. (Optional)"),
+		surgeCount:    rrsFlags.Int("surge", 0, "Number of extra instances to scale up by while the original instances are restarted. (Optional)"),
+		healthy:       rrsFlags.String("min-healthy", "", "Number, or percentage such as 75%, of the other instances that must be running before an instance is restarted. (Optional)"),
+		spread:        rrsFlags.String("spread-by", "", "Interleave the restarts across failure domains, cell or zone, through the V3 API. (Optional)"),
+		unhealthy:     rrsFlags.Bool("only-unhealthy", false, "Only restart instances that are crashed, down or stuck starting. (Optional)"),
+		watchFlag:     rrsFlags.Bool("watch", false, "Keep restarting unhealthy instances as they fail until interrupted, implies --only-unhealthy. (Optional)"),
+		watchEvery:    rrsFlags.Duration("watch-interval", 30*time.Second, "How often to look for unhealthy instances with --watch. (Optional)"),
+		age:           rrsFlags.Duration("older-than", 0, "Only restart instances that have been up for longer than this, e.g. 336h. (Optional)"),
+		resumeFlag:    rrsFlags.Bool("resume", false, "Skip the instances that were already restarted by an earlier, unfinished run. (Optional)"),
+		dry:           rrsFlags.Bool("dry-run", false, "Print the restart plan without restarting or scaling anything. (Optional)"),
+		parallel:      rrsFlags.Int("parallel-apps", 1, "Number of apps to restart at the same time when more than one app is given. (Optional)"),
+		soak:          rrsFlags.Duration("canary-soak", time.Minute, "How long to watch the canary instance before restarting the rest. (Optional)"),
+	}
+}
+
+func setFlagsAndReturnAppNames(args []string) ([]string, error) {
+	rrsFlags, flags := newFlagSet(args[0])
 	rrsFlags.Parse(args[1:])
 
 	if !rrsFlags.Parsed() {
-		return "", errors.New("Failed parsing command line arguments.")
+		return nil, errors.New("Failed parsing command line arguments.")
+	}
+
+	if *flags.size < 1 {
+		return nil, errors.New("The batch size must be at least 1, please try again.")
+	}
+
+	if *flags.percent < 0 || *flags.percent > 100 {
+		return nil, errors.New("The batch percent must be between 1 and 100, please try again.")
+	}
+
+	if isFlagSet(rrsFlags, "batch-percent") && isFlagSet(rrsFlags, "batch-size") {
+		return nil, errors.New("Only one of --batch-size and --batch-percent may be provided, please try again.")
+	}
+
+	if isFlagSet(rrsFlags, "max-cycles") && isFlagSet(rrsFlags, "timeout") {
+		return nil, errors.New("Only one of --max-cycles and --timeout may be provided, please try again.")
+	}
+
+	if *flags.timeout < 0 {
+		return nil, errors.New("The timeout can not be negative, please try again.")
+	}
+
+	if *flags.interval <= 0 || *flags.maxInterval <= 0 {
+		return nil, errors.New("The poll interval must be positive, please try again.")
+	}
+
+	switch *flags.order {
+	case numericOrder, reverseOrder, randomOrder, oldestFirstOrder:
+	default:
+		return nil, fmt.Errorf("Unknown --order %q, expected numeric, reverse, random or oldest-first.", *flags.order)
+	}
+
+	if *flags.surgeCount < 0 {
+		return nil, errors.New("The surge can not be negative, please try again.")
+	}
+
+	minHealthy, minHealthyPercent = 0, false
+	if *flags.healthy != "" {
+		value := strings.TrimSuffix(*flags.healthy, "%")
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 || (value != *flags.healthy && count > 100) {
+			return nil, fmt.Errorf("The minimum number of healthy instances %q is invalid, expected a number or a percentage such as 75%%, please try again.", *flags.healthy)
+		}
+		minHealthy, minHealthyPercent = count, value != *flags.healthy
+	}
+
+	if *flags.spread != "" && *flags.spread != cellSpread && *flags.spread != zoneSpread {
+		return nil, fmt.Errorf("Unknown --spread-by %q, expected cell or zone.", *flags.spread)
+	}
+
+	selectedInstances = nil
+	if *flags.only != "" {
+		var err error
+		if selectedInstances, err = parseInstanceList(*flags.only); err != nil {
+			return nil, err
+		}
+	}
+
+	if args[0] == "rolling-restage" {
+		var unsupported []string
+		rrsFlags.Visit(func(f *flag.Flag) {
+			if !restageFlags[f.Name] {
+				unsupported = append(unsupported, "--"+f.Name)
+			}
+		})
+
+		if len(unsupported) > 0 {
+			return nil, fmt.Errorf("rolling-restage rolls the new droplet out with a deployment and does not take %s, please try again.", strings.Join(unsupported, ", "))
+		}
+	}
+
+	if *flags.staging <= 0 || *flags.deploying <= 0 {
+		return nil, errors.New("The staging and deployment timeouts must be positive, please try again.")
+	}
+
+	if *flags.watchFlag && *flags.dry {
+		return nil, errors.New("Only one of --watch and --dry-run may be provided, please try again.")
+	}
+
+	if *flags.watchEvery <= 0 {
+		return nil, errors.New("The watch interval must be positive, please try again.")
+	}
+
+	if *flags.age < 0 {
+		return nil, errors.New("The minimum instance age can not be negative, please try again.")
+	}
+
+	if *flags.stable < 0 {
+		return nil, errors.New("The stability window can not be negative, please try again.")
+	}
+
+	if *flags.failureLimit < 0 {
+		return nil, errors.New("The maximum number of failures can not be negative, please try again.")
+	}
+
+	if *flags.failurePolicy != abortOnFailure && *flags.failurePolicy != continueOnFailure && *flags.failurePolicy != pauseOnFailure {
+		return nil, fmt.Errorf("Unknown --on-failure policy %q, expected abort, continue or pause.", *flags.failurePolicy)
+	}
+
+	if *flags.format != textOutput && *flags.format != jsonOutput {
+		return nil, fmt.Errorf("Unknown --output format %q, expected text or json.", *flags.format)
 	}
 
-	maxRestartWaitCycles = *maxCycles
+	if *flags.parallel < 1 {
+		return nil, errors.New("The number of parallel apps must be at least 1, please try again.")
+	}
+
+	if *flags.soak < 0 {
+		return nil, errors.New("The canary soak period can not be negative, please try again.")
+	}
+
+	if *flags.process != "" && *flags.everyProcess {
+		return nil, errors.New("Only one of --process and --all-processes may be provided, please try again.")
+	}
+
+	if *flags.health == "" && (*flags.status != 0 || *flags.body != "") {
+		return nil, errors.New("The --health-status and --health-body flags require --health-url, please try again.")
+	}
+
+	healthBody = nil
+	if *flags.body != "" {
+		var err error
+		if healthBody, err = regexp.Compile(*flags.body); err != nil {
+			return nil, fmt.Errorf("The health check body pattern is invalid: %s", err)
+		}
+	}
+
+	maxRestartWaitCycles = *flags.maxCycles
+	waitTimeout = *flags.timeout
+	pollInterval = *flags.interval
+	backoff = *flags.backoffFlag
+	maxPollInterval = *flags.maxInterval
+	batchSize = *flags.size
+	batchPercent = *flags.percent
+	canary = *flags.canaryFlag
+	canarySoak = *flags.soak
+	processType = *flags.process
+	allProcesses = *flags.everyProcess
+	healthURL = *flags.health
+	healthStatus = *flags.status
+	stableFor = *flags.stable
+	maxFailures = *flags.failureLimit
+	if !isFlagSet(rrsFlags, "max-failures") {
+		maxFailures = math.MaxInt32
+	}
+	onFailure = *flags.failurePolicy
+	parallelApps = *flags.parallel
+	labelSelector = *flags.selector
+	allInSpace = *flags.space
+	allInOrg = *flags.org
+	dryRun = *flags.dry
+	resume = *flags.resumeFlag
+	olderThan = *flags.age
+	instanceOrder = *flags.order
+	spreadBy = *flags.spread
+	surge = *flags.surgeCount
+	restage = args[0] == "rolling-restage"
+	stagingTimeout = *flags.staging
+	deploymentTimeout = *flags.deploying
+	onlyUnhealthy = *flags.unhealthy || *flags.watchFlag
+	watch = *flags.watchFlag
+	watchInterval = *flags.watchEvery
+	outputFormat = *flags.format
+	eventsFile = *flags.eventsPath
+	junitFile = *flags.junitPath
 	remainingArgs := rrsFlags.Args()
 
-	if len(remainingArgs) == 0 {
-		return "", errors.New("An application name was not provided. Usage: cf rolling-restart APP_NAME")
+	searching := *flags.selector != "" || *flags.space || *flags.org
+	if searching && len(remainingArgs) > 0 {
+		return nil, errors.New("Either app names or one of --selector, --all-in-space and --all-in-org may be provided, but not both, please try again.")
+	}
+
+	if *flags.space && *flags.org {
+		return nil, errors.New("Only one of --all-in-space and --all-in-org may be provided, please try again.")
 	}
 
-	if len(remainingArgs) > 1 {
-		return "", errors.New("Only a single app name is currently supported, please try again.")
+	if !searching && len(remainingArgs) == 0 {
+		return nil, errors.New("An application name was not provided. Usage: cf rolling-restart APP_NAME")
 	}
 
-	return remainingArgs[0], nil
+	return remainingArgs, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func validateCLISession(conn plugin.CliConnection) error {
@@ -253,21 +1540,53 @@ func validateCLISession(conn plugin.CliConnection) error {
 	return nil
 }
 
-func isInstanceRunning(conn plugin.CliConnection, appGUID string, instanceID string) (bool, error) {
-	var instanceStatuses Instances
-	var err error
+// isInstanceRunning reports whether the instance is running again since its
+// restart was requested. A restarted instance has not been up for longer than
+// the time since the request, or reports a start time after it, however long
+// it took before the instance was polled.
+func isInstanceRunning(instance Instance, requested time.Time) bool {
+	if instance.State != "RUNNING" {
+		return false
+	}
 
-	if instanceStatuses, err = getInstances(conn, appGUID); err != nil {
-		return false, err
+	if instance.Since != 0 && int64(instance.Since) >= requested.Unix() {
+		return true
 	}
 
-	instance := instanceStatuses[instanceID]
-	running := instance.State == "RUNNING" && instance.Uptime < 10
-	return running, nil
+	// The uptime is reported in whole seconds.
+	return time.Duration(instance.Uptime)*time.Second <= now().Sub(requested)+time.Second
+}
+
+// isInstanceUnhealthy reports whether the instance crashed, is down, or has
+// been starting for longer than the plugin waits for an instance to restart.
+func isInstanceUnhealthy(instance Instance) bool {
+	switch instance.State {
+	case "CRASHED", "DOWN":
+		return true
+	case "STARTING":
+		// The V3 API does not report since, but its uptime counts from when
+		// the instance was started.
+		started := now().Add(-time.Duration(instance.Uptime) * time.Second)
+		if instance.Since != 0 {
+			started = time.Unix(int64(instance.Since), 0)
+		}
+		return now().Sub(started) > maxWait(0)
+	}
+	return false
 }
 
-func restartInstance(conn plugin.CliConnection, appName string, instanceID string) error {
-	_, err := conn.CliCommand("restart-app-instance", appName, instanceID)
+func restartInstance(conn plugin.CliConnection, t target, instanceID string) (err error) {
+	defer func() {
+		requested := t.event(eventRestartRequested, instanceID)
+		requested.Error = errorMessage(err)
+		events.emit(requested)
+	}()
+
+	if t.processGUID != "" {
+		return restartProcessInstance(conn, t.processGUID, instanceID)
+	}
+
+	_, err = conn.CliCommand("restart-app-instance", t.appName, instanceID)
 	return err
 }
 
@@ -282,10 +1601,14 @@ func getappGUID(conn plugin.CliConnection, appName string) (string, error) {
 	return appGUID[0], nil
 }
 
-func getInstances(conn plugin.CliConnection, appGUID string) (Instances, error) {
+func getInstances(conn plugin.CliConnection, t target) (Instances, error) {
 	var instances Instances
 
-	instancesCurlURL := fmt.Sprintf("/v2/apps/%s/instances", appGUID)
+	if useV3 {
+		return getInstancesV3(conn, t.appGUID, t.processType)
+	}
+
+	instancesCurlURL := fmt.Sprintf("/v2/apps/%s/instances", t.appGUID)
 	instanceJSON, curlErr := conn.CliCommandWithoutTerminalOutput("curl", "-X", "GET", instancesCurlURL)
 	if curlErr != nil {
 		return nil, curlErr
@@ -296,9 +1619,60 @@ func getInstances(conn plugin.CliConnection, appGUID string) (Instances, error)
 		return nil, unmarshallErr
 	}
 
+	for instanceID, instance := range instances {
+		instance.Index, _ = strconv.Atoi(instanceID)
+		instances[instanceID] = instance
+	}
+
 	return instances, nil
 }
 
+// getTargets returns the processes of the application to restart. Without a
+// process flag only the web process is restarted the way it always has been,
+// except with --all-in-org where apps can live outside the targeted space and
+// have to be restarted through the V3 API.
+func getTargets(conn plugin.CliConnection, appName string, appGUID string) ([]target, error) {
+	selectedType := processType
+	if selectedType == "" && !allProcesses && allInOrg {
+		selectedType = "web"
+	}
+
+	if selectedType == "" && !allProcesses {
+		return []target{{appName: appName, appGUID: appGUID, processType: "web"}}, nil
+	}
+
+	if !useV3 {
+		return nil, errors.New("Restarting individual process types requires the V3 API, which this foundation does not advertise.")
+	}
+
+	processes, err := getProcesses(conn, appGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	for _, process := range processes {
+		if !allProcesses && process.Type != selectedType {
+			continue
+		}
+
+		if process.Instances == 0 {
+			printFormatted("Skipping the %s process of %s, it has no instances.\n", process.Type, appName)
+			continue
+		}
+
+		targets = append(targets, target{appName: appName, appGUID: appGUID, processType: process.Type, processGUID: process.GUID})
+	}
+
+	if !allProcesses && len(targets) == 0 {
+		return nil, fmt.Errorf("The app %s does not have any running %s instances.", appName, selectedType)
+	}
+
+	return targets, nil
+}
+
+// getKeysFor returns the instance IDs in numeric order, so that instance 10
+// comes after instance 2.
 func getKeysFor(m map[string]Instance) []string {
 	keys := make([]string, len(m))
 	i := 0
@@ -306,7 +1680,12 @@ func getKeysFor(m map[string]Instance) []string {
 		keys[i] = k
 		i++
 	}
-	sort.Strings(keys)
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
 	return keys
 }
 
@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"code.cloudfoundry.org/cli/plugin/models"
 	"github.com/cloudfoundry/cli/cf/errors"
+	"github.com/cloudfoundry/cli/plugin"
 	"github.com/cloudfoundry/cli/plugin/pluginfakes"
 	"github.com/stretchr/testify/require"
 )
@@ -17,13 +25,27 @@ var (
 	cliConn *pluginfakes.FakeCliConnection
 
 	output        []string
+	outputMutex   sync.Mutex
 	spinnerBuffer bytes.Buffer
 	exitCode      int
-
-	twoInstanceResponse      = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
-	alwaysRestartingResponse = []string{"{", "\"0\": {", "\"state\": \"STARTING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
-	singleInstanceResponse   = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "}", "}"}
-	badInstanceResponse      = []string{"bad", "response"}
+	fakeNow       = time.Date(2019, time.May, 1, 12, 0, 0, 0, time.UTC)
+	clockMutex    sync.Mutex
+
+	twoInstanceResponse       = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
+	alwaysRestartingResponse  = []string{"{", "\"0\": {", "\"state\": \"STARTING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
+	fourInstanceResponse      = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
+	oneStuckInstanceResponse  = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"STARTING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
+	singleInstanceResponse    = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "}", "}"}
+	badInstanceResponse       = []string{"bad", "response"}
+	v2RootResponse            = []string{"{", "\"links\": {", "\"cloud_controller_v2\": {", "\"href\": \"https://api.example.com/v2\"", "}", "}", "}"}
+	v3RootResponse            = []string{"{", "\"links\": {", "\"cloud_controller_v2\": {", "\"href\": \"https://api.example.com/v2\"", "},", "\"cloud_controller_v3\": {", "\"href\": \"https://api.example.com/v3\"", "}", "}", "}"}
+	processesResponse         = []string{"{", "\"resources\": [", "{", "\"guid\": \"web-process-guid\",", "\"type\": \"web\",", "\"instances\": 2", "},", "{", "\"guid\": \"worker-process-guid\",", "\"type\": \"worker\",", "\"instances\": 2", "},", "{", "\"guid\": \"scheduler-process-guid\",", "\"type\": \"scheduler\",", "\"instances\": 0", "}", "]", "}"}
+	flappingInstanceResponse  = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 2,", "\"since\": 1511990300", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
+	twoInstanceStatsResponse  = []string{"{", "\"resources\": [", "{", "\"type\": \"web\",", "\"index\": 0,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.1\"", "},", "{", "\"type\": \"web\",", "\"index\": 1,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.2\"", "}", "]", "}"}
+	agedInstanceResponse      = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 1300000,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"RUNNING\",", "\"uptime\": 1209601,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"RUNNING\",", "\"uptime\": 3600,", "\"since\": 1511990327", "}", "}"}
+	unhealthyInstanceResponse = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5000,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"CRASHED\",", "\"uptime\": 0,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"STARTING\",", "\"uptime\": 0,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"DOWN\",", "\"uptime\": 0,", "\"since\": 1511990327", "}", "}"}
+	zonedStatsResponse        = []string{"{", "\"resources\": [", "{", "\"type\": \"web\",", "\"index\": 0,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.1\",", "\"zone\": \"z1\"", "},", "{", "\"type\": \"web\",", "\"index\": 1,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.1\",", "\"zone\": \"z2\"", "},", "{", "\"type\": \"web\",", "\"index\": 2,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.2\",", "\"zone\": \"z1\"", "},", "{", "\"type\": \"web\",", "\"index\": 3,", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"host\": \"10.0.0.2\",", "\"zone\": \"z2\"", "}", "]", "}"}
+	sixInstanceResponse       = []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"4\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"5\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "}", "}"}
 )
 
 type testError struct {
@@ -66,10 +88,35 @@ func TestMain(m *testing.M) {
 	oldSpinner := spinner
 	defer func() { spinner = oldSpinner }()
 
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+
+	oldNow := now
+	defer func() { now = oldNow }()
+
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+
+	oldDetach := detach
+	defer func() { detach = oldDetach }()
+
 	maxRestartWaitCycles = 1
 	spinner = fakeSpinner
+	sleep = sleepStub
+	now = nowStub
+	withInterrupt = context.WithCancel
+	detach = func(conn plugin.CliConnection) plugin.CliConnection { return conn }
+
+	oldStateDir := stateDir
+	defer func() { stateDir = oldStateDir }()
+
+	var err error
+	if stateDir, err = ioutil.TempDir("", "rolling-restart-state"); err != nil {
+		panic(err)
+	}
 
 	code := m.Run()
+	os.RemoveAll(stateDir)
 
 	os.Exit(code)
 }
@@ -88,11 +135,12 @@ func TestRollingRestart_Run_Success(t *testing.T) {
 	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
 	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(1))
 
-	require.Equal(t, 4, cliConn.CliCommandWithoutTerminalOutputCallCount())
-	require.Equal(t, []string{"app", "testApp", "--guid"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(0))
-	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(1))
+	require.Equal(t, 5, cliConn.CliCommandWithoutTerminalOutputCallCount())
+	require.Equal(t, []string{"curl", "-X", "GET", "/"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(0))
+	require.Equal(t, []string{"app", "testApp", "--guid"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(1))
 	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(2))
 	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(3))
+	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(4))
 
 	require.Equal(t, 4, len(output))
 	require.Equal(t, "Beginning restart of app instances for testApp.\n", output[0])
@@ -119,11 +167,12 @@ func TestRollingRestart_Run_Success_SingleAppInstance(t *testing.T) {
 	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(1))
 	require.Equal(t, []string{"scale", "testApp", "-i", "1"}, cliConn.CliCommandArgsForCall(2))
 
-	require.Equal(t, 4, cliConn.CliCommandWithoutTerminalOutputCallCount())
-	require.Equal(t, []string{"app", "testApp", "--guid"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(0))
-	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(1))
-	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(2))
+	require.Equal(t, 5, cliConn.CliCommandWithoutTerminalOutputCallCount())
+	require.Equal(t, []string{"curl", "-X", "GET", "/"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(0))
+	require.Equal(t, []string{"app", "testApp", "--guid"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(1))
 	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(2))
+	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(3))
+	require.Equal(t, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(4))
 
 	require.Equal(t, 7, len(output))
 	require.Equal(t, "Only found a single instance of testApp, scaling up to two instances.\n", output[0])
@@ -149,18 +198,46 @@ func TestRollingRestart_Run_NoAppNameProvided(t *testing.T) {
 
 func TestRollingRestart_Run_MultipleAppNameProvided(t *testing.T) {
 	resetOutput()
-	rr.Run(cliConn, []string{"rolling-restart", "firstApp", "secondApp"})
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupMultipleAppsStub("firstApp", "secondApp")
+	setupAnyAppCliCommandStub()
+
+	rr.Run(cliConn, []string{"rolling-restart", "firstApp", "missingApp", "secondApp"})
 
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "firstApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "firstApp", "1"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, []string{"restart-app-instance", "secondApp", "0"}, cliConn.CliCommandArgsForCall(2))
+	require.Equal(t, []string{"restart-app-instance", "secondApp", "1"}, cliConn.CliCommandArgsForCall(3))
+
+	require.Equal(t, "Rolling restart results:\nAPP         RESULT\nfirstApp    succeeded\nmissingApp  failed\nsecondApp   succeeded\n", output[len(output)-2])
+	require.Equal(t, "2 succeeded, 1 failed, 0 skipped.\n", output[len(output)-1])
 	require.Equal(t, exitCode, 1)
-	require.Equal(t, "Only a single app name is currently supported, please try again.\n", output[0])
+}
+
+func TestRollingRestart_Run_ParallelApps(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupMultipleAppsStub("firstApp", "secondApp", "thirdApp")
+	setupAnyAppCliCommandStub()
+
+	rr.Run(cliConn, []string{"rolling-restart", "--parallel-apps", "2", "firstApp", "secondApp", "thirdApp"})
+
+	require.Equal(t, 6, cliConn.CliCommandCallCount())
+	require.Equal(t, "Rolling restart results:\nAPP        RESULT\nfirstApp   succeeded\nsecondApp  succeeded\nthirdApp   succeeded\n", output[len(output)-2])
+	require.Equal(t, exitCode, 0)
 }
 
 func TestRollingRestart_Run_ArguementParsingError(t *testing.T) {
 	resetOutput()
-	rr.Run(cliConn, []string{"rolling-restart", "firstApp", "secondApp"})
+	rr.Run(cliConn, []string{"rolling-restart", "--parallel-apps", "0", "firstApp", "secondApp"})
 
 	require.Equal(t, exitCode, 1)
-	require.Equal(t, "Only a single app name is currently supported, please try again.\n", output[0])
+	require.Equal(t, "The number of parallel apps must be at least 1, please try again.\n", output[0])
 }
 
 func TestRollingRestart_Run_NotLoggedIn(t *testing.T) {
@@ -301,6 +378,9 @@ func TestRollingRestart_Run_InstanceDoesNotRestartInCycleLimit(t *testing.T) {
 }
 
 func TestRollingRestart_Run_InstanceDoesNotRestartCustomCycleLimit(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
 	resetOutput()
 	setupIsLoggedInStub(true, false)
 	setupHasOrganizationStub(true, false)
@@ -315,74 +395,1018 @@ func TestRollingRestart_Run_InstanceDoesNotRestartCustomCycleLimit(t *testing.T)
 	require.Contains(t, output[2], "Application did not restart within 2 Second(s), failing out. Check your current application state.")
 }
 
-func setupHasSpaceStub(hasSpace bool, throwError bool) {
-	cliConn.HasSpaceStub = func() (bool, error) {
-		if throwError {
-			return false, errors.New("CLI FAILURE\n")
-		}
-		return hasSpace, nil
-	}
+func TestRollingRestart_Run_Success_BatchSize(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--batch-size", "2", "testApp"})
+
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "2"}, cliConn.CliCommandArgsForCall(2))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "3"}, cliConn.CliCommandArgsForCall(3))
+
+	require.Equal(t, 5, cliConn.CliCommandWithoutTerminalOutputCallCount())
+
+	require.Equal(t, 5, len(output))
+	require.Equal(t, "Beginning restart of app instances for testApp.\n", output[0])
+	require.Equal(t, "Restarting 2 instances of testApp at a time.\n", output[1])
+	require.Equal(t, "Checking status of instances 0, 1.\n", output[2])
+	require.Equal(t, "Checking status of instances 2, 3.\n", output[3])
+	require.Equal(t, "Finished restart of app instances for testApp.\n", output[4])
 }
 
-func setupHasOrganizationStub(hasOrganization bool, throwError bool) {
-	cliConn.HasOrganizationStub = func() (bool, error) {
-		if throwError {
-			return false, errors.New("CLI FAILURE\n")
-		}
-		return hasOrganization, nil
-	}
+func TestRollingRestart_Run_Success_BatchPercentNeverRestartsEveryInstance(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--batch-percent", "100", "testApp"})
+
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+	require.Equal(t, "Restarting 3 instances of testApp at a time.\n", output[1])
+	require.Equal(t, "Checking status of instances 0, 1, 2.\n", output[2])
+	require.Equal(t, "Checking status of instance 3.\n", output[3])
+	require.Equal(t, exitCode, 0)
 }
 
-func setupIsLoggedInStub(isLoggedIn bool, throwError bool) {
-	cliConn.IsLoggedInStub = func() (bool, error) {
-		if throwError {
-			return false, errors.New("CLI FAILURE\n")
+func TestRollingRestart_Run_InvalidBatchSize(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--batch-size", "0", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "The batch size must be at least 1, please try again.\n", output[0])
+}
+
+func TestRollingRestart_Run_BatchSizeAndPercentProvided(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--batch-size", "2", "--batch-percent", "50", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Only one of --batch-size and --batch-percent may be provided, please try again.\n", output[0])
+}
+
+func TestRollingRestart_Run_Success_Canary(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--canary", "--canary-soak", "2s", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(1))
+
+	require.Equal(t, 8, cliConn.CliCommandWithoutTerminalOutputCallCount())
+
+	require.Equal(t, 6, len(output))
+	require.Equal(t, "Beginning restart of app instances for testApp.\n", output[0])
+	require.Equal(t, "Restarting instance 0 of testApp as a canary.\n", output[1])
+	require.Equal(t, "Checking status of instance 0.\n", output[2])
+	require.Equal(t, "Watching canary instance 0 for 2s.\n", output[3])
+	require.Equal(t, "Checking status of instance 1.\n", output[4])
+	require.Equal(t, "Finished restart of app instances for testApp.\n", output[5])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_CanaryCrashesDuringSoak(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(twoInstanceResponse, twoInstanceResponse, twoInstanceResponse, alwaysRestartingResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--canary", "--canary-soak", "5s", "testApp"})
+
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Canary instance 0 did not stay healthy, no other instances of testApp were restarted.\n", output[4])
+	require.Equal(t, "Canary instance 0 went to STARTING during the soak period.\n", output[5])
+}
+
+func TestRollingRestart_Run_Success_V3Stats(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(1))
+
+	require.Equal(t, 5, cliConn.CliCommandWithoutTerminalOutputCallCount())
+	require.Equal(t, []string{"curl", "-X", "GET", "/"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(0))
+	require.Equal(t, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes/web/stats"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(2))
+	require.Equal(t, exitCode, 0)
+}
+
+func TestGetInstances_V3StatsMapping(t *testing.T) {
+	resetOutput()
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+
+	instances, err := getInstancesV3(cliConn, "valid-app-guid", "web")
+
+	require.NoError(t, err)
+	require.Equal(t, Instances{
+		"0": {Index: 0, State: "RUNNING", Uptime: 5, Host: "10.0.0.1"},
+		"1": {Index: 1, State: "RUNNING", Uptime: 5, Host: "10.0.0.2"},
+	}, instances)
+}
+
+func TestRollingRestart_Run_Success_ProcessType(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--process", "worker", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+
+	require.Equal(t, 8, cliConn.CliCommandWithoutTerminalOutputCallCount())
+	require.Equal(t, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(2))
+	require.Equal(t, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes/worker/stats"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(3))
+	require.Equal(t, []string{"curl", "-X", "DELETE", "/v3/processes/worker-process-guid/instances/0"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(4))
+	require.Equal(t, []string{"curl", "-X", "DELETE", "/v3/processes/worker-process-guid/instances/1"}, cliConn.CliCommandWithoutTerminalOutputArgsForCall(6))
+
+	require.Equal(t, "Beginning restart of app instances for testApp (worker).\n", output[0])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_Success_AllProcesses(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupV3CliCommandWithoutTerminalOutputStub(twoInstanceStatsResponse)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--all-processes", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, "Skipping the scheduler process of testApp, it has no instances.\n", output[0])
+	require.Equal(t, "Beginning restart of app instances for testApp (web).\n", output[1])
+	require.Equal(t, "Finished restart of app instances for testApp (web).\n", output[4])
+	require.Equal(t, "Beginning restart of app instances for testApp (worker).\n", output[5])
+	require.Equal(t, "Finished restart of app instances for testApp (worker).\n", output[8])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_ProcessTypeRequiresV3(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--process", "worker", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Failed to get the processes for testApp.\n", output[0])
+	require.Equal(t, "Restarting individual process types requires the V3 API, which this foundation does not advertise.\n", output[1])
+}
+
+func TestRollingRestart_Run_Success_StableFor(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--stable-for", "3s", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, 11, cliConn.CliCommandWithoutTerminalOutputCallCount())
+	require.Equal(t, "Finished restart of app instances for testApp.\n", output[3])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_InstanceFlapsDuringStableFor(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(twoInstanceResponse, twoInstanceResponse, flappingInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--stable-for", "3s", "testApp"})
+
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Equal(t, "Instance 0 restarted before it was stable for 3s.\n", output[2])
+	require.Contains(t, output[3], "Application did not restart within")
+	require.Equal(t, exitCode, 1)
+}
+
+func TestRollingRestart_Run_SingleAppInstanceRestoredWhenRestartFails(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	setupCliCommandStub(false, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "testApp"})
+
+	require.Equal(t, 3, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "2"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, []string{"scale", "testApp", "-i", "1"}, cliConn.CliCommandArgsForCall(2))
+
+	require.Equal(t, "Failed to restart instance 0.\n", output[4])
+	require.Equal(t, "Scaling testApp back down to one instance.\n", output[6])
+	require.Equal(t, exitCode, 1)
+}
+
+func TestRollingRestart_Run_SingleAppInstanceScaleDownThrowsError(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		if args[0] == "scale" && args[3] == "1" {
+			return nil, &testError{1, "CliCommandStubError"}
 		}
-		return isLoggedIn, nil
+		advanceClock(restartDuration)
+		return nil, nil
 	}
+
+	rr.Run(cliConn, []string{"rolling-restart", "testApp"})
+
+	require.Equal(t, 3, cliConn.CliCommandCallCount())
+	require.Equal(t, "Scaling testApp back down to one instance.\n", output[5])
+	require.Equal(t, "Failed to scale testApp back down to one instance.\n", output[6])
+	require.Equal(t, "CliCommandStubError\n", output[7])
+	require.Equal(t, 8, len(output))
+	require.Equal(t, exitCode, 1)
 }
 
-func setupCliCommandWihtoutTerminalOutputStub(getGUIDSuccess bool, getInstanceStatusSuccess bool, instanceResponse []string) {
-	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
-		if reflect.DeepEqual(args, []string{"app", "testApp", "--guid"}) && getGUIDSuccess {
-			return []string{"valid-app-guid"}, nil
-		} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}) && getInstanceStatusSuccess {
-			return instanceResponse, nil
+func TestRollingRestart_Run_InterruptedWhileWaiting(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+	withInterrupt = func(context.Context) (context.Context, context.CancelFunc) { return ctx, cancel }
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+	restart := cliConn.CliCommandStub
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		if args[0] == "restart-app-instance" && args[2] == "1" {
+			cancel()
 		}
-		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+		return restart(args...)
 	}
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "5", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output, "Stopped waiting for instance 1 of testApp.\n")
+	require.Equal(t, []string{
+		"The restart of testApp was interrupted.\n",
+		"  Restarted instances 0, 1.\n",
+		"  Did not restart instances 2, 3.\n",
+		"The following instances of testApp failed to restart:\n",
+		"  instance 1: The restart was interrupted before the instance was running again.\n",
+	}, output[len(output)-5:])
 }
 
-func setupCliCommandStub(restartSuccess bool, scaleSuccess bool) {
+func TestRollingRestart_Run_SingleAppInstanceRestoredWhenInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+	withInterrupt = func(context.Context) (context.Context, context.CancelFunc) { return ctx, cancel }
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	setupCliCommandStub(true, true)
+	scale := cliConn.CliCommandStub
 	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
-		if args[0] == "restart-app-instance" && args[1] == "testApp" && (args[2] == "0" || args[2] == "1") && restartSuccess {
-			return nil, nil
-		} else if args[0] == "scale" && args[1] == "testApp" && args[2] == "-i" && args[3] == "2" && scaleSuccess {
-			return nil, nil
+		if args[0] == "scale" && args[3] == "2" {
+			cancel()
 		}
-		return nil, &testError{1, "CliCommandStubError"}
+		return scale(args...)
 	}
-}
 
-func printlnStub(a ...interface{}) (n int, err error) {
-	output = append(output, fmt.Sprintln(a...))
-	return 0, nil
-}
+	detached := &pluginfakes.FakeCliConnection{}
+	oldDetach := detach
+	defer func() { detach = oldDetach }()
+	detach = func(plugin.CliConnection) plugin.CliConnection { return detached }
 
-func printfStub(format string, a ...interface{}) (n int, err error) {
-	output = append(output, fmt.Sprintf(format, a...))
-	return 0, nil
-}
+	rr.Run(cliConn, []string{"rolling-restart", "testApp"})
 
-func printRedBoldStub(a ...interface{}) (n int, err error) {
-	return 0, nil
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "2"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, 1, detached.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "1"}, detached.CliCommandArgsForCall(0))
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, []string{
+		"Scaling testApp back down to one instance.\n",
+		"The restart of testApp was interrupted.\n",
+		"  Did not restart instance 0.\n",
+	}, output[len(output)-3:])
 }
 
-func exitStub(code int) {
-	exitCode = code
-}
+func TestRollingRestart_Run_SingleAppInstanceRestoreFailsWhenInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+	withInterrupt = func(context.Context) (context.Context, context.CancelFunc) { return ctx, cancel }
 
-func resetOutput() {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, singleInstanceResponse)
+	setupCliCommandStub(true, true)
+	scale := cliConn.CliCommandStub
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		if ctx.Err() != nil {
+			return nil, errors.New("connection is shut down")
+		}
+		if args[0] == "scale" && args[3] == "2" {
+			cancel()
+		}
+		return scale(args...)
+	}
+
+	rr.Run(cliConn, []string{"rolling-restart", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "1"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, []string{
+		"Scaling testApp back down to one instance.\n",
+		"Failed to scale testApp back down to one instance.\n",
+		"connection is shut down\n",
+		"The restart of testApp was interrupted.\n",
+		"  Did not restart instance 0.\n",
+	}, output[len(output)-5:])
+}
+
+func TestRollingRestart_Run_Success_OnlyUnhealthy(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(unhealthyInstanceResponse, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--only-unhealthy", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 3, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "2"}, cliConn.CliCommandArgsForCall(1))
+	require.Equal(t, []string{"restart-app-instance", "testApp", "3"}, cliConn.CliCommandArgsForCall(2))
+	require.Equal(t, "Skipping instance 0 of testApp, it is RUNNING.\n", output[0])
+}
+
+func TestRollingRestart_Run_WatchHealsUntilInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+	withInterrupt = func(context.Context) (context.Context, context.CancelFunc) { return ctx, cancel }
+
+	rounds := 0
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if d == time.Minute {
+			if rounds++; rounds == 2 {
+				cancel()
+			}
+		}
+		return sleepStub(ctx, d)
+	}
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(unhealthyInstanceResponse, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--watch", "--watch-interval", "1m", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 2, rounds)
+	require.Equal(t, 3, cliConn.CliCommandCallCount())
+	require.Equal(t, "Watching 1 app(s) for unhealthy instances every 1m0s, press Ctrl-C to stop.\n", output[0])
+	require.Contains(t, output, "No instances of testApp need to be restarted.\n")
+	require.Equal(t, "Stopped watching for unhealthy instances.\n", output[len(output)-1])
+}
+
+func TestRollingRestart_Run_WatchReportsFailedHeals(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	oldWithInterrupt := withInterrupt
+	defer func() { withInterrupt = oldWithInterrupt }()
+	withInterrupt = func(context.Context) (context.Context, context.CancelFunc) { return ctx, cancel }
+
+	rounds := 0
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if d == time.Minute {
+			if rounds++; rounds == 2 {
+				cancel()
+			}
+		}
+		return sleepStub(ctx, d)
+	}
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, unhealthyInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--watch", "--watch-interval", "1m", "--max-cycles", "1", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Len(t, report.Apps, 1)
+	require.Contains(t, output, "Failed to heal testApp, checking it again in 1m0s.\n")
+	require.Equal(t, []string{
+		"Stopped watching for unhealthy instances.\n",
+		"2 heal(s) failed while watching.\n",
+	}, output[len(output)-2:])
+}
+
+func TestIsInstanceUnhealthy(t *testing.T) {
+	require.True(t, isInstanceUnhealthy(Instance{State: "CRASHED"}))
+	require.True(t, isInstanceUnhealthy(Instance{State: "DOWN"}))
+	require.True(t, isInstanceUnhealthy(Instance{State: "STARTING", Since: int(fakeNow.Add(-time.Hour).Unix())}))
+	require.False(t, isInstanceUnhealthy(Instance{State: "STARTING", Since: int(fakeNow.Unix())}))
+	require.False(t, isInstanceUnhealthy(Instance{State: "STARTING"}))
+	require.False(t, isInstanceUnhealthy(Instance{State: "RUNNING", Uptime: 5000}))
+}
+
+func TestIsInstanceUnhealthy_StuckStartingOnV3(t *testing.T) {
+	defer func() { useV3 = false }()
+	useV3 = true
+
+	resetOutput()
+	setupV3CliCommandWithoutTerminalOutputStub([]string{fmt.Sprintf(`{"resources": [{"type": "web", "index": 0, "state": "STARTING", "uptime": 0}, {"type": "web", "index": 1, "state": "STARTING", "uptime": %d}]}`, int(maxWait(0).Seconds())+1)})
+	web := target{appName: "testApp", appGUID: "valid-app-guid", processType: "web"}
+
+	instances, err := getInstances(cliConn, web)
+	require.NoError(t, err)
+	require.False(t, isInstanceUnhealthy(instances["0"]))
+	require.True(t, isInstanceUnhealthy(instances["1"]))
+}
+
+func TestRollingRestart_Run_Success_MinHealthyPercent(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--min-healthy", "75%", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+}
+
+func TestRollingRestart_Run_MinHealthyNotReached(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, unhealthyInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "1", "--min-healthy", "2", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, []string{
+		"Waiting for 2 of the other instances of testApp to be running before restarting instance 0, 0 are.\n",
+		"Not restarting instance 0 of testApp.\n",
+		"Only 0 of the other instances of testApp were running within 1 Second(s), at least 2 must be.\n",
+	}, output[1:4])
+}
+
+func TestRollingRestart_Run_MinHealthyExcludesRestartedInstances(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	oneCrashedInstanceResponse := []string{"{", "\"0\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990275", "},", "\"1\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"2\": {", "\"state\": \"RUNNING\",", "\"uptime\": 5,", "\"since\": 1511990327", "},", "\"3\": {", "\"state\": \"CRASHED\",", "\"uptime\": 0,", "\"since\": 1511990327", "}", "}"}
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneCrashedInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "1", "--batch-size", "2", "--min-healthy", "2", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Contains(t, output, "Waiting for 2 of the other instances of testApp to be running before restarting instance 1, 1 are.\n")
+	require.Contains(t, output, "Not restarting instance 1 of testApp.\n")
+}
+
+func TestRollingRestart_Run_MinHealthyCanNeverBeMet(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--min-healthy", "2", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{
+		"Failed to plan the restart of testApp.\n",
+		"--min-healthy requires 2 of the other instances to be running, but at most 1 can be while instances are restarting.\n",
+	}, output[len(output)-2:])
+}
+
+func TestRollingRestart_Run_MinHealthyCanNeverBeMetInBatches(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--batch-size", "2", "--min-healthy", "75%", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Contains(t, output, "--min-healthy requires 3 of the other instances to be running, but at most 2 can be while instances are restarting.\n")
+}
+
+func TestRollingRestart_Run_InvalidMinHealthy(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--min-healthy", "150%", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Contains(t, output[0], "The minimum number of healthy instances \"150%\" is invalid")
+}
+
+func TestRollingRestart_Run_Success_Surge(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputSequenceStub(fourInstanceResponse, sixInstanceResponse)
+	setupSurgeCliCommandStub()
+
+	rr.Run(cliConn, []string{"rolling-restart", "--surge", "2", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 6, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "6"}, cliConn.CliCommandArgsForCall(0))
+	for i := 0; i < 4; i++ {
+		require.Equal(t, []string{"restart-app-instance", "testApp", fmt.Sprint(i)}, cliConn.CliCommandArgsForCall(i+1))
+	}
+	require.Equal(t, []string{"scale", "testApp", "-i", "4"}, cliConn.CliCommandArgsForCall(5))
+	require.Equal(t, "Scaling testApp up to 6 instances before restarting the original instances.\n", output[0])
+	require.Contains(t, output, "Finished scaling testApp to 6 instances.\n")
+	require.Contains(t, output, "Scaling testApp back down to 4 instances.\n")
+}
+
+func TestRollingRestart_Run_SurgeInstancesDoNotStart(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, fourInstanceResponse)
+	setupSurgeCliCommandStub()
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "1", "--surge", "2", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"scale", "testApp", "-i", "6"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"scale", "testApp", "-i", "4"}, cliConn.CliCommandArgsForCall(1))
+	require.Contains(t, output, "The added instances 4, 5 of testApp did not start within 1 Second(s), no instances were restarted.\n")
+}
+
+func TestRollingRestart_Run_OnFailureContinue(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--on-failure", "continue", "testApp"})
+
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+	require.Equal(t, "The following instances of testApp failed to restart:\n", output[len(output)-2])
+	require.Contains(t, output[len(output)-1], "  instance 1: Did not restart within")
+	require.Equal(t, exitCode, 1)
+}
+
+func TestRollingRestart_Run_OnFailureContinueStopsAtMaxFailures(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--on-failure", "continue", "--max-failures", "0", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, "Stopping the restart of testApp after 1 failed instance(s).\n", output[4])
+	require.Equal(t, "The following instances of testApp failed to restart:\n", output[5])
+	require.Equal(t, exitCode, 1)
+}
+
+func TestRollingRestart_Run_OnFailurePauseDeclined(t *testing.T) {
+	oldStdin := stdin
+	defer func() { stdin = oldStdin }()
+	stdin = strings.NewReader("n\n")
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--on-failure", "pause", "testApp"})
+
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+	require.Equal(t, "Continue restarting the remaining instances of testApp? [y/N]: ", output[4])
+	require.Equal(t, exitCode, 1)
+}
+
+func TestContinueAfterFailure_PauseSharesStdinBetweenApps(t *testing.T) {
+	oldStdin, oldOnFailure, oldMaxFailures := stdin, onFailure, maxFailures
+	defer func() { stdin, onFailure, maxFailures = oldStdin, oldOnFailure, oldMaxFailures }()
+	stdin, onFailure, maxFailures = strings.NewReader("y\ny\n"), pauseOnFailure, 10
+
+	resetOutput()
+	answers := make(chan bool, 2)
+	for _, appName := range []string{"firstApp", "secondApp"} {
+		go func(appName string) {
+			answers <- continueAfterFailure(target{appName: appName, processType: "web"}, 1)
+		}(appName)
+	}
+
+	require.True(t, <-answers)
+	require.True(t, <-answers)
+	require.Len(t, output, 2)
+}
+
+func TestRollingRestart_Run_UnknownFailurePolicy(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--on-failure", "retry", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Unknown --on-failure policy \"retry\", expected abort, continue or pause.\n", output[0])
+}
+
+func TestRollingRestart_Run_Success_Selector(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupAnyAppCliCommandStub()
+	cliConn.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid"}}, nil)
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		switch strings.Join(args, " ") {
+		case "curl -X GET /":
+			return v3RootResponse, nil
+		case "curl -X GET /v3/apps?label_selector=team%3Dpayments%2Cenv%21%3Ddev&space_guids=space-guid":
+			return []string{`{"pagination": {"next": {"href": "https://api.example.com/v3/apps?page=2"}},`, `"resources": [{"guid": "first-guid", "name": "firstApp", "state": "STARTED"}]}`}, nil
+		case "curl -X GET /v3/apps?page=2":
+			return []string{`{"pagination": {"next": null},`, `"resources": [{"guid": "second-guid", "name": "secondApp", "state": "STARTED"}]}`}, nil
+		case "curl -X GET /v3/apps/first-guid/processes/web/stats", "curl -X GET /v3/apps/second-guid/processes/web/stats":
+			return twoInstanceStatsResponse, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+
+	rr.Run(cliConn, []string{"rolling-restart", "--selector", "team=payments,env!=dev"})
+
+	require.Equal(t, 4, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "firstApp", "0"}, cliConn.CliCommandArgsForCall(0))
+	require.Equal(t, []string{"restart-app-instance", "secondApp", "1"}, cliConn.CliCommandArgsForCall(3))
+	require.Equal(t, "Found 2 app(s) matching team=payments,env!=dev in the targeted space.\n", output[0])
+	require.Equal(t, "Rolling restart results:\nAPP        RESULT\nfirstApp   succeeded\nsecondApp  succeeded\n", output[len(output)-2])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_SelectorAndAppNameProvided(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--selector", "team=payments", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Either app names or one of --selector, --all-in-space and --all-in-org may be provided, but not both, please try again.\n", output[0])
+}
+
+func TestRollingRestart_Run_Success_AllInOrg(t *testing.T) {
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	cliConn.GetCurrentOrgReturns(plugin_models.Organization{OrganizationFields: plugin_models.OrganizationFields{Guid: "org-guid"}}, nil)
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		switch strings.Join(args, " ") {
+		case "curl -X GET /":
+			return v3RootResponse, nil
+		case "curl -X GET /v3/apps?organization_guids=org-guid":
+			return []string{`{"pagination": {"next": null}, "resources": [`,
+				`{"guid": "first-guid", "name": "firstApp", "state": "STARTED"},`,
+				`{"guid": "stopped-guid", "name": "stoppedApp", "state": "STOPPED"},`,
+				`{"guid": "second-guid", "name": "secondApp", "state": "STARTED"}]}`}, nil
+		case "curl -X GET /v3/apps/first-guid/processes", "curl -X GET /v3/apps/second-guid/processes":
+			return processesResponse, nil
+		case "curl -X GET /v3/apps/first-guid/processes/web/stats", "curl -X GET /v3/apps/second-guid/processes/web/stats":
+			return twoInstanceStatsResponse, nil
+		case "curl -X DELETE /v3/processes/web-process-guid/instances/0", "curl -X DELETE /v3/processes/web-process-guid/instances/1":
+			advanceClock(restartDuration)
+			return []string{}, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+
+	rr.Run(cliConn, []string{"rolling-restart", "--all-in-org", "--parallel-apps", "2"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Equal(t, "Skipping stoppedApp, the app is stopped.\n", output[0])
+	require.Equal(t, "Found 2 app(s) in the targeted org.\n", output[1])
+	require.Equal(t, "Rolling restart results:\nAPP         RESULT\nfirstApp    succeeded\nsecondApp   succeeded\nstoppedApp  skipped (stopped)\n", output[len(output)-2])
+	require.Equal(t, "2 succeeded, 0 failed, 1 skipped.\n", output[len(output)-1])
+	require.Equal(t, exitCode, 0)
+}
+
+func TestRollingRestart_Run_AllInSpaceAndOrgProvided(t *testing.T) {
+	resetOutput()
+	rr.Run(cliConn, []string{"rolling-restart", "--all-in-space", "--all-in-org"})
+
+	require.Equal(t, exitCode, 1)
+	require.Equal(t, "Only one of --all-in-space and --all-in-org may be provided, please try again.\n", output[0])
+}
+
+func setupHasSpaceStub(hasSpace bool, throwError bool) {
+	cliConn.HasSpaceStub = func() (bool, error) {
+		if throwError {
+			return false, errors.New("CLI FAILURE\n")
+		}
+		return hasSpace, nil
+	}
+}
+
+func setupHasOrganizationStub(hasOrganization bool, throwError bool) {
+	cliConn.HasOrganizationStub = func() (bool, error) {
+		if throwError {
+			return false, errors.New("CLI FAILURE\n")
+		}
+		return hasOrganization, nil
+	}
+}
+
+func setupIsLoggedInStub(isLoggedIn bool, throwError bool) {
+	cliConn.IsLoggedInStub = func() (bool, error) {
+		if throwError {
+			return false, errors.New("CLI FAILURE\n")
+		}
+		return isLoggedIn, nil
+	}
+}
+
+func setupCliCommandWihtoutTerminalOutputStub(getGUIDSuccess bool, getInstanceStatusSuccess bool, instanceResponse []string) {
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/"}) {
+			return v2RootResponse, nil
+		} else if reflect.DeepEqual(args, []string{"app", "testApp", "--guid"}) && getGUIDSuccess {
+			return []string{"valid-app-guid"}, nil
+		} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}) && getInstanceStatusSuccess {
+			return instanceResponse, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+}
+
+// setupCliCommandWihtoutTerminalOutputSequenceStub returns the given instance
+// responses in order, repeating the last one once they have all been used.
+func setupCliCommandWihtoutTerminalOutputSequenceStub(instanceResponses ...[]string) {
+	calls := 0
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/"}) {
+			return v2RootResponse, nil
+		} else if reflect.DeepEqual(args, []string{"app", "testApp", "--guid"}) {
+			return []string{"valid-app-guid"}, nil
+		} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v2/apps/valid-app-guid/instances"}) {
+			response := instanceResponses[len(instanceResponses)-1]
+			if calls < len(instanceResponses) {
+				response = instanceResponses[calls]
+			}
+			calls++
+			return response, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+}
+
+func setupV3CliCommandWithoutTerminalOutputStub(statsResponse []string) {
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/"}) {
+			return v3RootResponse, nil
+		} else if reflect.DeepEqual(args, []string{"app", "testApp", "--guid"}) {
+			return []string{"valid-app-guid"}, nil
+		} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes"}) {
+			return processesResponse, nil
+		} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes/web/stats"}) ||
+			reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v3/apps/valid-app-guid/processes/worker/stats"}) {
+			return statsResponse, nil
+		} else if args[0] == "curl" && (args[2] == "DELETE" || args[2] == "POST") {
+			advanceClock(restartDuration)
+			return []string{}, nil
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+}
+
+// setupMultipleAppsStub resolves each of the given app names to its own GUID
+// and reports two running instances for every one of them.
+func setupMultipleAppsStub(appNames ...string) {
+	cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+		if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/"}) {
+			return v2RootResponse, nil
+		}
+
+		for _, appName := range appNames {
+			if reflect.DeepEqual(args, []string{"app", appName, "--guid"}) {
+				return []string{appName + "-guid"}, nil
+			} else if reflect.DeepEqual(args, []string{"curl", "-X", "GET", "/v2/apps/" + appName + "-guid/instances"}) {
+				return twoInstanceResponse, nil
+			}
+		}
+		return nil, &testError{1, "CliCommandWithoutTerminalStubError"}
+	}
+}
+
+func setupAnyAppCliCommandStub() {
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		advanceClock(restartDuration)
+		return nil, nil
+	}
+}
+
+func setupCliCommandStub(restartSuccess bool, scaleSuccess bool) {
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		if args[0] == "restart-app-instance" && args[1] == "testApp" && len(args) == 3 && restartSuccess {
+			advanceClock(restartDuration)
+			return nil, nil
+		} else if args[0] == "scale" && args[1] == "testApp" && args[2] == "-i" && (args[3] == "1" || args[3] == "2") && scaleSuccess {
+			advanceClock(restartDuration)
+			return nil, nil
+		}
+		return nil, &testError{1, "CliCommandStubError"}
+	}
+}
+
+func setupSurgeCliCommandStub() {
+	cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+		if (args[0] == "restart-app-instance" || args[0] == "scale") && args[1] == "testApp" {
+			advanceClock(restartDuration)
+			return nil, nil
+		}
+		return nil, &testError{1, "CliCommandStubError"}
+	}
+}
+
+func printlnStub(a ...interface{}) (n int, err error) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	output = append(output, fmt.Sprintln(a...))
+	return 0, nil
+}
+
+func printfStub(format string, a ...interface{}) (n int, err error) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	output = append(output, fmt.Sprintf(format, a...))
+	return 0, nil
+}
+
+func printRedBoldStub(a ...interface{}) (n int, err error) {
+	return 0, nil
+}
+
+func sleepStub(ctx context.Context, d time.Duration) error {
+	advanceClock(d)
+	return ctx.Err()
+}
+
+func nowStub() time.Time {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	return fakeNow
+}
+
+func advanceClock(d time.Duration) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	fakeNow = fakeNow.Add(d)
+}
+
+// restartDuration is how long restarting or scaling takes in the tests, so
+// that the instances reporting an uptime of five seconds were started after
+// their restart was requested.
+const restartDuration = 5 * time.Second
+
+func exitStub(code int) {
+	exitCode = code
+}
+
+func resetOutput() {
 	output = []string{}
+	exitCode = 0
 	cliConn = &pluginfakes.FakeCliConnection{}
 }
+
+func TestCommandConnection_RunsCf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolling-restart-cf")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := "#!/bin/sh\nif [ \"$1\" = scale ]; then echo \"FAILED\"; exit 1; fi\necho \"$@\"\necho done\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cf"), []byte(script), 0755))
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir)
+
+	rpc := &pluginfakes.FakeCliConnection{}
+	conn := newCommandConnection(rpc)
+
+	lines, err := conn.CliCommandWithoutTerminalOutput("curl", "-X", "GET", "/")
+	require.Nil(t, err)
+	require.Equal(t, []string{"curl -X GET /", "done"}, lines)
+
+	_, err = conn.CliCommand("scale", "testApp", "-i", "1")
+	require.EqualError(t, err, "exit status 1: FAILED")
+	require.Equal(t, 0, rpc.CliCommandCallCount())
+}
+
+func TestRollingRestart_GetMetadata_OptionsFromFlags(t *testing.T) {
+	metadata := rr.GetMetadata()
+
+	restart := metadata.Commands[0].UsageDetails
+	require.Equal(t, "cf rolling-restart [OPTIONS] APP_NAME [APP_NAME...]", restart.Usage)
+	require.Equal(t, "Number of instances to restart at the same time, defaults to 1", restart.Options["-batch-size"])
+	require.Equal(t, "Print the restart plan without restarting or scaling anything", restart.Options["-dry-run"])
+
+	restage := metadata.Commands[1].UsageDetails
+	require.Equal(t, "cf rolling-restage [OPTIONS] APP_NAME [APP_NAME...]", restage.Usage)
+	require.Len(t, restage.Options, len(restageFlags))
+	require.Equal(t, restart.Options["-staging-timeout"], restage.Options["-staging-timeout"])
+	require.NotContains(t, restage.Options, "-batch-size")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/fatih/color"
 )
@@ -15,22 +16,29 @@ var states = map[string]string{
 
 // Spinner provides state for a basic command line spinner.
 type Spinner struct {
+	mutex  sync.Mutex
 	writer io.Writer
 	state  string
 }
 
 // NewSpinner returns a new Spinner object.
 func NewSpinner(writer io.Writer) *Spinner {
-	return &Spinner{writer, "|"}
+	return &Spinner{writer: writer, state: "|"}
 }
 
 // Next progresses the spinner to the next state.
 func (spinner *Spinner) Next() {
+	spinner.mutex.Lock()
+	defer spinner.mutex.Unlock()
+
 	spinner.state = states[spinner.state]
 	fmt.Fprintf(spinner.writer, "\r%s", spinner.state)
 }
 
 // Done outputs a green OK in place of the spinner when called.
 func (spinner *Spinner) Done() {
+	spinner.mutex.Lock()
+	defer spinner.mutex.Unlock()
+
 	color.New(color.FgGreen, color.Bold).Fprint(spinner.writer, "\rOK\n")
 }
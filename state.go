@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateDir is where the progress of each rollout is kept for --resume.
+var stateDir = defaultStateDir()
+
+// rolloutState is the progress of the rolling restart of one app, saved after
+// every batch so that an interrupted rollout can be resumed.
+type rolloutState struct {
+	mutex   sync.Mutex
+	resumed bool
+
+	App       string                          `json:"app"`
+	GUID      string                          `json:"guid"`
+	Started   time.Time                       `json:"started"`
+	Droplet   string                          `json:"droplet,omitempty"`
+	Processes map[string]map[string]time.Time `json:"processes"`
+}
+
+func defaultStateDir() string {
+	home := os.Getenv("CF_HOME")
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	return filepath.Join(home, ".cf", "rolling-restart")
+}
+
+func statePath(appGUID string) string {
+	return filepath.Join(stateDir, appGUID+".json")
+}
+
+// startRollout returns the progress to keep for the rollout of the app. With
+// --resume the saved progress is picked up when there is any. Nothing is
+// saved for a --dry-run.
+func startRollout(appName string, appGUID string) (*rolloutState, error) {
+	if resume {
+		state, err := loadRolloutState(appGUID)
+		if err != nil {
+			return nil, err
+		}
+
+		if state != nil {
+			state.resumed = true
+			printFormatted("Resuming the restart of %s that started at %s.\n", appName, state.Started.Format(time.RFC3339))
+			return state, nil
+		}
+		printFormatted("No saved progress was found for %s, restarting every instance.\n", appName)
+	}
+
+	if dryRun {
+		return nil, nil
+	}
+
+	state := newRolloutState(appName, appGUID)
+	if err := state.save(); err != nil {
+		printFormatted("Failed to save the progress of %s, it can not be resumed: %s\n", appName, err)
+	}
+	return state, nil
+}
+
+// newRolloutState starts tracking a new rollout of the app.
+func newRolloutState(appName string, appGUID string) *rolloutState {
+	return &rolloutState{App: appName, GUID: appGUID, Started: now(), Processes: map[string]map[string]time.Time{}}
+}
+
+// loadRolloutState reads the saved progress of the app, returning nil when
+// there is none.
+func loadRolloutState(appGUID string) (*rolloutState, error) {
+	contents, err := ioutil.ReadFile(statePath(appGUID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &rolloutState{}
+	if err = json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("The saved progress in %s is invalid: %s", statePath(appGUID), err)
+	}
+
+	if state.Processes == nil {
+		state.Processes = map[string]map[string]time.Time{}
+	}
+	return state, nil
+}
+
+// alreadyRestarted returns when the instance was restarted earlier in the
+// rollout. The uptime of the instance must agree that it has been running
+// since the rollout started, otherwise it has to be restarted again.
+func (s *rolloutState) alreadyRestarted(processType string, instanceID string, instance Instance) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	restarted, found := s.Processes[processType][instanceID]
+	if !found || restarted.Before(s.Started) {
+		return time.Time{}, false
+	}
+
+	runningSince := now().Add(-time.Duration(instance.Uptime) * time.Second)
+	return restarted, !runningSince.Before(s.Started)
+}
+
+// record saves the instances of the batch that restarted successfully.
+func (s *rolloutState) record(processType string, restartedIDs []string, failures []instanceFailure) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Processes[processType] == nil {
+		s.Processes[processType] = map[string]time.Time{}
+	}
+
+	for _, instanceID := range restartedIDs {
+		failed := false
+		for _, failure := range failures {
+			failed = failed || failure.instanceID == instanceID
+		}
+
+		if !failed {
+			s.Processes[processType][instanceID] = now()
+		}
+	}
+
+	return s.saveLocked()
+}
+
+// recordDroplet saves the droplet staged by rolling-restage, once staging has
+// succeeded.
+func (s *rolloutState) recordDroplet(dropletGUID string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Droplet = dropletGUID
+	return s.saveLocked()
+}
+
+// save writes the progress to the state directory.
+func (s *rolloutState) save() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.saveLocked()
+}
+
+func (s *rolloutState) saveLocked() error {
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(statePath(s.GUID), contents, 0600)
+}
+
+// remove deletes the saved progress once the rollout has finished.
+func (s *rolloutState) remove() error {
+	if s == nil {
+		return nil
+	}
+
+	if err := os.Remove(statePath(s.GUID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart_Run_ResumeSkipsRestartedInstances(t *testing.T) {
+	started := fakeNow.Add(-time.Minute)
+	saveState(t, started, map[string]time.Time{"0": started.Add(30 * time.Second)})
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--resume", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 1, cliConn.CliCommandCallCount())
+	require.Equal(t, []string{"restart-app-instance", "testApp", "1"}, cliConn.CliCommandArgsForCall(0))
+	require.Contains(t, output, "Resuming the restart of testApp that started at "+started.Format(time.RFC3339)+".\n")
+	require.Contains(t, output, "Skipping instance 0 of testApp, already restarted at "+started.Add(30*time.Second).Format(time.RFC3339)+".\n")
+
+	_, err := os.Stat(statePath("valid-app-guid"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRollingRestart_Run_ResumeRestartsInstancesOlderThanTheRollout(t *testing.T) {
+	started := fakeNow.Add(-2 * time.Second)
+	saveState(t, started, map[string]time.Time{"0": started.Add(time.Second)})
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--resume", "testApp"})
+
+	require.Equal(t, exitCode, 0)
+	require.Equal(t, 2, cliConn.CliCommandCallCount())
+}
+
+func TestRollingRestart_Run_ProgressKeptWhenRestartFails(t *testing.T) {
+	oldMaxRestartWaitCycles := maxRestartWaitCycles
+	defer func() { maxRestartWaitCycles = oldMaxRestartWaitCycles }()
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, oneStuckInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--max-cycles", "1", "testApp"})
+
+	require.Equal(t, exitCode, 1)
+
+	state, err := loadRolloutState("valid-app-guid")
+	require.NoError(t, err)
+	require.Equal(t, "testApp", state.App)
+	require.Contains(t, state.Processes["web"], "0")
+	require.NotContains(t, state.Processes["web"], "1")
+}
+
+func TestRollingRestart_Run_DryRun_Resume(t *testing.T) {
+	started := fakeNow.Add(-time.Minute)
+	saveState(t, started, map[string]time.Time{"1": started})
+	defer os.Remove(statePath("valid-app-guid"))
+
+	resetOutput()
+	setupIsLoggedInStub(true, false)
+	setupHasOrganizationStub(true, false)
+	setupHasSpaceStub(true, false)
+	setupCliCommandWihtoutTerminalOutputStub(true, true, twoInstanceResponse)
+	setupCliCommandStub(true, true)
+
+	rr.Run(cliConn, []string{"rolling-restart", "--dry-run", "--resume", "testApp"})
+
+	require.Equal(t, 0, cliConn.CliCommandCallCount())
+	require.Contains(t, output, "  Skip instance 1, already restarted at "+started.Format(time.RFC3339)+".\n")
+	require.Contains(t, output, "  Batch 1: restart instance 0.\n")
+}
+
+func saveState(t *testing.T, started time.Time, restarted map[string]time.Time) {
+	state := &rolloutState{App: "testApp", GUID: "valid-app-guid", Started: started, Processes: map[string]map[string]time.Time{"web": restarted}}
+	require.NoError(t, state.save())
+}
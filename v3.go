@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/cli/plugin"
+)
+
+// apiRoot is the subset of the Cloud Controller root document used to
+// determine which API versions a foundation supports.
+type apiRoot struct {
+	Links map[string]*struct {
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// processStats is the response of the V3 process stats endpoint.
+type processStats struct {
+	Resources []struct {
+		Index  int    `json:"index"`
+		State  string `json:"state"`
+		Uptime int    `json:"uptime"`
+		Host   string `json:"host"`
+		Zone   string `json:"zone"`
+	} `json:"resources"`
+}
+
+// Process describes a single process type of an application.
+type Process struct {
+	GUID      string `json:"guid"`
+	Type      string `json:"type"`
+	Instances int    `json:"instances"`
+}
+
+// processList is the response of the V3 app processes endpoint.
+type processList struct {
+	Resources []Process `json:"resources"`
+}
+
+// appList is a page of the V3 apps endpoint.
+type appList struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []struct {
+		GUID  string `json:"guid"`
+		Name  string `json:"name"`
+		State string `json:"state"`
+	} `json:"resources"`
+}
+
+// curlV3 issues a request against the V3 API and returns the response body,
+// turning any errors reported by the Cloud Controller into a Go error.
+func curlV3(conn plugin.CliConnection, method string, path string, body string) ([]byte, error) {
+	args := []string{"curl", "-X", method, path}
+	if body != "" {
+		args = append(args, "-d", body)
+	}
+
+	output, err := conn.CliCommandWithoutTerminalOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []byte(strings.Join(output, ""))
+
+	var apiErrors struct {
+		Errors []struct {
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(response, &apiErrors) == nil && len(apiErrors.Errors) > 0 {
+		return nil, errors.New(apiErrors.Errors[0].Detail)
+	}
+
+	return response, nil
+}
+
+// supportsV3 reports whether the API root of the targeted foundation
+// advertises the V3 Cloud Controller API.
+func supportsV3(conn plugin.CliConnection) (bool, error) {
+	var root apiRoot
+
+	rootJSON, err := conn.CliCommandWithoutTerminalOutput("curl", "-X", "GET", "/")
+	if err != nil {
+		return false, err
+	}
+
+	if err = json.Unmarshal([]byte(strings.Join(rootJSON, "")), &root); err != nil {
+		return false, nil
+	}
+
+	return root.Links["cloud_controller_v3"] != nil, nil
+}
+
+func getInstancesV3(conn plugin.CliConnection, appGUID string, processType string) (Instances, error) {
+	var stats processStats
+
+	statsCurlURL := fmt.Sprintf("/v3/apps/%s/processes/%s/stats", appGUID, processType)
+	statsJSON, curlErr := curlV3(conn, "GET", statsCurlURL, "")
+	if curlErr != nil {
+		return nil, curlErr
+	}
+
+	unmarshallErr := json.Unmarshal(statsJSON, &stats)
+	if unmarshallErr != nil {
+		return nil, unmarshallErr
+	}
+
+	instances := Instances{}
+	for _, resource := range stats.Resources {
+		instances[strconv.Itoa(resource.Index)] = Instance{
+			Index:  resource.Index,
+			State:  resource.State,
+			Uptime: resource.Uptime,
+			Host:   resource.Host,
+			Zone:   resource.Zone,
+		}
+	}
+
+	return instances, nil
+}
+
+func getProcesses(conn plugin.CliConnection, appGUID string) ([]Process, error) {
+	var processes processList
+
+	processesJSON, err := curlV3(conn, "GET", fmt.Sprintf("/v3/apps/%s/processes", appGUID), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(processesJSON, &processes); err != nil {
+		return nil, err
+	}
+
+	return processes.Resources, nil
+}
+
+func restartProcessInstance(conn plugin.CliConnection, processGUID string, instanceID string) error {
+	_, err := curlV3(conn, "DELETE", fmt.Sprintf("/v3/processes/%s/instances/%s", processGUID, instanceID), "")
+	return err
+}
+
+func scaleProcess(conn plugin.CliConnection, processGUID string, numberOfInstances int) error {
+	body := fmt.Sprintf(`{"instances":%d}`, numberOfInstances)
+	_, err := curlV3(conn, "POST", fmt.Sprintf("/v3/processes/%s/actions/scale", processGUID), body)
+	return err
+}
+
+// findApps returns the apps in the targeted space, or the whole targeted org
+// with --all-in-org, narrowed down by the label selector when one is given.
+func findApps(conn plugin.CliConnection) ([]application, error) {
+	if !useV3 {
+		return nil, errors.New("Finding apps to restart requires the V3 API, which this foundation does not advertise.")
+	}
+
+	query := url.Values{}
+	if labelSelector != "" {
+		query.Set("label_selector", labelSelector)
+	}
+
+	if allInOrg {
+		org, err := conn.GetCurrentOrg()
+		if err != nil {
+			return nil, err
+		}
+		query.Set("organization_guids", org.Guid)
+	} else {
+		space, err := conn.GetCurrentSpace()
+		if err != nil {
+			return nil, err
+		}
+		query.Set("space_guids", space.Guid)
+	}
+
+	apps, err := listApps(conn, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []application
+	for _, app := range apps.Resources {
+		found = append(found, application{name: app.Name, guid: app.GUID, stopped: app.State == "STOPPED"})
+	}
+
+	return found, nil
+}
+
+// listApps returns every app matching the query, following the pagination
+// links of the V3 apps endpoint. The returned list holds all resources.
+func listApps(conn plugin.CliConnection, query url.Values) (appList, error) {
+	var apps appList
+
+	path := "/v3/apps?" + query.Encode()
+	for path != "" {
+		var page appList
+
+		pageJSON, err := curlV3(conn, "GET", path, "")
+		if err != nil {
+			return apps, err
+		}
+
+		if err = json.Unmarshal(pageJSON, &page); err != nil {
+			return apps, err
+		}
+
+		apps.Resources = append(apps.Resources, page.Resources...)
+
+		path = ""
+		if page.Pagination.Next != nil && page.Pagination.Next.Href != "" {
+			next, err := url.Parse(page.Pagination.Next.Href)
+			if err != nil {
+				return apps, err
+			}
+			path = next.RequestURI()
+		}
+	}
+
+	return apps, nil
+}